@@ -0,0 +1,95 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"fmt"
+)
+
+// AttnArm arms the Notecard's ATTN pin to fire upon any of the comma-separated conditions in
+// modes, such as "files" (a change to any of the specified notefiles), or after seconds have
+// elapsed if seconds is non-zero
+func (context *Context) AttnArm(modes string, files []string, seconds int) (err error) {
+	req := NewRequest("card.attn")
+	req["mode"] = "arm"
+	if modes != "" {
+		req["mode"] = "arm," + modes
+	}
+	if len(files) > 0 {
+		req["files"] = files
+	}
+	if seconds > 0 {
+		req["seconds"] = seconds
+	}
+	err = context.Request(req)
+	return
+}
+
+// AttnFired returns whether the ATTN pin has fired since it was armed, along with the
+// notefiles whose changes caused it to fire
+func (context *Context) AttnFired() (fired bool, files []string, err error) {
+	rsp, err := context.Transaction(NewRequest("card.attn"))
+	if err != nil {
+		return
+	}
+	fired = boolField(rsp, "set")
+	files, _ = rsp["files"].([]string)
+	return
+}
+
+// HostSleep asks the Notecard to cut power to the host via the ATTN pin, waking it after
+// seconds or upon any of the comma-separated conditions in wakeModes (as for AttnArm),
+// and to hold the host's state across the sleep.  Because the host loses power, this
+// doesn't return if successful; upon power-up the host should call HostResume.
+func (context *Context) HostSleep(seconds int, state []byte, wakeModes string, files []string) (err error) {
+
+	if seconds <= 0 && wakeModes == "" {
+		err = fmt.Errorf("card.attn: sleeping requires a duration or a wake condition")
+		return
+	}
+
+	req := NewRequest("card.attn")
+	req["mode"] = "sleep"
+	if wakeModes != "" {
+		req["mode"] = "sleep," + wakeModes
+	}
+	if len(files) > 0 {
+		req["files"] = files
+	}
+	if seconds > 0 {
+		req["seconds"] = seconds
+	}
+	if len(state) > 0 {
+		req["payload"] = EncodePayload(state, nil)
+	}
+	err = context.Request(req)
+
+	// Done
+	return
+
+}
+
+// HostResume retrieves the state saved by HostSleep after the host has been powered back up,
+// along with the notefiles whose changes caused it to wake, if any.  If the host is starting
+// up for a reason other than waking from HostSleep, state is empty.
+func (context *Context) HostResume() (state []byte, files []string, err error) {
+
+	req := NewRequest("card.attn")
+	req["start"] = true
+	rsp, err := context.Transaction(req)
+	if err != nil {
+		return
+	}
+	files, _ = rsp["files"].([]string)
+	state, err = DecodePayload(stringField(rsp, "payload"), nil)
+	if err != nil {
+		err = fmt.Errorf("card.attn: invalid saved state: %s", err)
+		return
+	}
+
+	// Done
+	return
+
+}
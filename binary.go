@@ -0,0 +1,253 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+)
+
+// The binary store is transferred outside of JSON, terminated by a newline.  To guarantee that
+// the data contains no newline, it is COBS-encoded and then XOR'ed with the newline character.
+const binaryEOP = '\n'
+
+// BinaryOptions modifies the framing used by BinaryTransmit and BinaryReceive.  The zero
+// value selects the recommended framing: COBS encoding, with MD5 verification.
+type BinaryOptions struct {
+
+	// Transfer the data without COBS encoding, for firmware that predates it.  Because the
+	// transfer is terminated by a newline, only data that contains no newline may be sent.
+	NoCOBS bool
+
+	// Skip MD5 verification of the received data
+	NoVerify bool
+}
+
+// BinaryInfo returns the length of the data in the Notecard's binary store, the length that
+// it will occupy when COBS-encoded, and the maximum length that the store can hold
+func (context *Context) BinaryInfo() (length int, cobs int, max int, err error) {
+
+	rsp, err := context.Transaction(NewRequest("card.binary"))
+	if err != nil {
+		return
+	}
+	length = intField(rsp, "length")
+	cobs = intField(rsp, "cobs")
+	max = intField(rsp, "max")
+
+	// Done
+	return
+
+}
+
+// BinaryReset empties the Notecard's binary store
+func (context *Context) BinaryReset() (err error) {
+	req := NewRequest("card.binary")
+	req["delete"] = true
+	err = context.Request(req)
+	return
+}
+
+// BinaryTransmit appends data to the Notecard's binary store
+func (context *Context) BinaryTransmit(data []byte, opts BinaryOptions) (err error) {
+
+	// Frame the data
+	digest := md5.Sum(data)
+	req := NewRequest("card.binary.put")
+	req["status"] = hex.EncodeToString(digest[:])
+	var framed []byte
+	if opts.NoCOBS {
+		if bytes.IndexByte(data, binaryEOP) >= 0 {
+			err = fmt.Errorf("card.binary.put: data containing a newline requires COBS framing")
+			return
+		}
+		framed = data
+		req["length"] = len(framed)
+	} else {
+		framed = cobsEncode(data, binaryEOP)
+		req["cobs"] = len(framed)
+	}
+	framed = append(framed, binaryEOP)
+	reqJSON, err := ObjectToJSON(req)
+	if err != nil {
+		return
+	}
+
+	// Issue the request and follow it immediately with the data, without letting any other
+	// transaction intervene
+	var rspJSON []byte
+	var rsp map[string]interface{}
+	began, err := context.streamBegin(reqJSON, TransactionOptions{})
+	if err == nil {
+		rspJSON, rsp, err = context.binaryRequest(reqJSON)
+	}
+	if err == nil && !IsError(nil, rsp) {
+		_, err = context.TransactionFn(context, true, framed)
+		if err != nil {
+			context.resetRequired = true
+		}
+	}
+	context.streamEnd(began, rspJSON, rsp, err)
+	if err != nil {
+		return
+	}
+	if IsError(nil, rsp) {
+		err = fmt.Errorf("card.binary.put: %s", ErrorString(nil, rsp))
+		return
+	}
+
+	// The card verifies the data against the MD5 that we supplied, reporting any mismatch
+	_, err = context.Transaction(NewRequest("card.binary"))
+
+	// Done
+	return
+
+}
+
+// BinaryReceive reads length bytes at the specified offset from the Notecard's binary store
+func (context *Context) BinaryReceive(offset int, length int, opts BinaryOptions) (data []byte, err error) {
+
+	req := NewRequest("card.binary.get")
+	req["offset"] = offset
+	req["length"] = length
+	if opts.NoCOBS {
+		req["cobs"] = false
+	}
+	reqJSON, err := ObjectToJSON(req)
+	if err != nil {
+		return
+	}
+
+	// The response is followed by the framed data.  Depending upon the transport, some or all
+	// of the data may arrive along with the response, so keep reading until it is terminated.
+	// The response can't be retried if it fails the check enabled by EnableCRC, because the
+	// data that follows it is already in flight.
+	var rsp map[string]interface{}
+	var rspJSON, framed []byte
+	began, err := context.streamBegin(reqJSON, TransactionOptions{})
+	if err == nil {
+		crcSeq := uint16(0)
+		if context.crcEnabled {
+			context.crcSeq++
+			crcSeq = context.crcSeq
+			reqJSON = crcAdd(reqJSON, crcSeq)
+		}
+		rspJSON, err = context.TransactionFn(context, false, append(reqJSON, '\n'))
+		if err == nil {
+			eol := bytes.IndexByte(rspJSON, '\n')
+			if eol < 0 {
+				err = fmt.Errorf("card.binary.get: unterminated reply from module %s", ErrCardIo)
+			} else {
+				framed = rspJSON[eol+1:]
+				rspJSON = rspJSON[:eol+1]
+				if crcSeq != 0 {
+					rspJSON, err = crcCheck(rspJSON, crcSeq)
+				}
+			}
+		}
+		if err == nil {
+			rsp, err = JSONToObject(rspJSON)
+			if err != nil {
+				err = fmt.Errorf("card.binary.get: error unmarshaling reply from module: %s %s", err, ErrCardIo)
+			}
+		}
+	}
+
+	// The card follows the response with data only if it could satisfy the request
+	for err == nil && !IsError(nil, rsp) && !bytes.HasSuffix(framed, []byte{binaryEOP}) {
+		err = context.transCanceled()
+		if err == nil {
+			var more []byte
+			more, err = context.TransactionFn(context, false, []byte{})
+			framed = append(framed, more...)
+		}
+	}
+	context.streamEnd(began, rspJSON, rsp, err)
+	if err != nil {
+		return
+	}
+	if IsError(nil, rsp) {
+		err = fmt.Errorf("card.binary.get: %s", ErrorString(nil, rsp))
+		return
+	}
+
+	// Unframe and verify the data
+	framed = framed[:len(framed)-1]
+	if opts.NoCOBS {
+		data = framed
+	} else {
+		data = cobsDecode(framed, binaryEOP)
+	}
+	if !opts.NoVerify {
+		digest := md5.Sum(data)
+		if hex.EncodeToString(digest[:]) != stringField(rsp, "status") {
+			err = fmt.Errorf("card.binary.get: MD5 mismatch on received data %s", ErrCardIo)
+			return
+		}
+	}
+
+	// Done
+	return
+
+}
+
+// Transmit a binary store request, returning its response, while already holding the I/O port
+func (context *Context) binaryRequest(reqJSON []byte) (rspJSON []byte, rsp map[string]interface{}, err error) {
+	if context.crcEnabled {
+		rspJSON, err = context.transactionCRC(false, append(reqJSON, '\n'))
+	} else {
+		rspJSON, err = context.TransactionFn(context, false, append(reqJSON, '\n'))
+	}
+	if err != nil {
+		context.resetRequired = true
+		return
+	}
+	rsp, err = JSONToObject(rspJSON)
+	if err != nil {
+		err = fmt.Errorf("error unmarshaling reply from module: %s %s", err, ErrCardIo)
+		context.resetRequired = true
+	}
+	return
+}
+
+// COBS-encode data, XOR'ing the result with eop so that eop never appears in the output
+func cobsEncode(data []byte, eop byte) (encoded []byte) {
+	encoded = make([]byte, 1, len(data)+len(data)/254+2)
+	codeOffset := 0
+	code := byte(1)
+	for _, ch := range data {
+		if ch != 0 {
+			encoded = append(encoded, ch^eop)
+			code++
+		}
+		if ch == 0 || code == 0xFF {
+			encoded[codeOffset] = code ^ eop
+			code = 1
+			codeOffset = len(encoded)
+			encoded = append(encoded, 0)
+		}
+	}
+	encoded[codeOffset] = code ^ eop
+	return
+}
+
+// Decode data encoded by cobsEncode
+func cobsDecode(encoded []byte, eop byte) (data []byte) {
+	data = make([]byte, 0, len(encoded))
+	for i := 0; i < len(encoded); {
+		code := encoded[i] ^ eop
+		i++
+		for j := byte(1); j < code && i < len(encoded); j++ {
+			data = append(data, encoded[i]^eop)
+			i++
+		}
+		if code < 0xFF && i < len(encoded) {
+			data = append(data, 0)
+		}
+	}
+	return
+}
@@ -0,0 +1,289 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// A simulated binary store, which checks the framing, length, and MD5 of the data it is sent
+// as the card does, and frames the data that it returns
+type testBinaryStore struct {
+	data      []byte
+	putStatus string
+	putLength int
+	putCOBS   bool
+	putErr    string
+	pending   []byte
+	corrupt   bool
+}
+
+// Respond to a binary store request, or accept the data that follows card.binary.put
+func (store *testBinaryStore) respond(noResponse bool, reqJSON []byte) (rspJSON []byte, err error) {
+
+	// The data that follows card.binary.put
+	if store.putStatus != "" {
+		framed := bytes.TrimSuffix(reqJSON, []byte{binaryEOP})
+		if !noResponse || len(framed) != len(reqJSON)-1 || bytes.IndexByte(framed, binaryEOP) >= 0 {
+			store.putErr = "binary data is improperly framed {io}"
+		} else if len(framed) != store.putLength {
+			store.putErr = fmt.Sprintf("binary data length %d doesn't match %d {io}", len(framed), store.putLength)
+		} else {
+			data := framed
+			if store.putCOBS {
+				data = cobsDecode(framed, binaryEOP)
+			}
+			digest := md5.Sum(data)
+			if hex.EncodeToString(digest[:]) != store.putStatus {
+				store.putErr = "binary data MD5 mismatch {io}"
+			} else {
+				store.data = append(store.data, data...)
+			}
+		}
+		store.putStatus = ""
+		return
+	}
+
+	// The remainder of the data that follows card.binary.get
+	if len(reqJSON) == 0 {
+		rspJSON = store.pending
+		store.pending = nil
+		return
+	}
+
+	req, err := JSONToObject(reqJSON)
+	if err != nil {
+		return
+	}
+	switch stringField(req, "req") {
+	case "card.binary.put":
+		store.putStatus = stringField(req, "status")
+		store.putLength = intField(req, "length")
+		store.putCOBS = intField(req, "cobs") != 0
+		if store.putCOBS {
+			store.putLength = intField(req, "cobs")
+		}
+		return []byte("{}\n"), nil
+	case "card.binary":
+		if store.putErr != "" {
+			rspJSON = ErrorJSON(store.putErr, nil)
+			store.putErr = ""
+			return
+		}
+		return []byte(fmt.Sprintf("{\"length\":%d}\n", len(store.data))), nil
+	case "card.binary.get":
+		offset := intField(req, "offset")
+		length := intField(req, "length")
+		if offset+length > len(store.data) {
+			return []byte("{\"err\":\"binary store doesn't contain the requested data\"}\n"), nil
+		}
+		data := store.data[offset : offset+length]
+		digest := md5.Sum(data)
+		if store.corrupt {
+			digest[0]++
+		}
+		framed := data
+		if cobs, present := req["cobs"].(bool); !present || cobs {
+			framed = cobsEncode(data, binaryEOP)
+		}
+		framed = append(framed, binaryEOP)
+
+		// Return part of the data with the response, as a stream transport may
+		half := len(framed) / 2
+		rspJSON = []byte(fmt.Sprintf("{\"status\":\"%s\"}\n", hex.EncodeToString(digest[:])))
+		rspJSON = append(rspJSON, framed[:half]...)
+		store.pending = framed[half:]
+		return
+	}
+	return []byte("{\"err\":\"unknown request\"}\n"), nil
+
+}
+
+// Open a context whose card has a simulated binary store
+func newTestBinaryContext(store *testBinaryStore) (context *Context) {
+	context = newTestContext(nil)
+	context.TransactionFn = func(context *Context, noResponse bool, reqJSON []byte) ([]byte, error) {
+		return store.respond(noResponse, reqJSON)
+	}
+	return
+}
+
+// Data whose framing exercises zeroes, newlines, and runs too long for a single COBS block
+func testBinaryData() (data []byte) {
+	data = []byte{0, '\n', 0, 0, 0xFF, '\n' ^ 0xFF, 1}
+	for i := 0; i < 600; i++ {
+		data = append(data, byte(i%255)+1)
+	}
+	data = append(data, 0, '\n')
+	return
+}
+
+func TestCOBSRoundTrip(t *testing.T) {
+	lengths := []int{0, 1, 253, 254, 255, 508, 509}
+	for _, length := range lengths {
+		for _, fill := range []byte{0, '\n', 0x55} {
+			data := bytes.Repeat([]byte{fill}, length)
+			encoded := cobsEncode(data, binaryEOP)
+			if bytes.IndexByte(encoded, binaryEOP) >= 0 {
+				t.Errorf("%d bytes of %#x: encoding contains the end of packet byte", length, fill)
+			}
+			decoded := cobsDecode(encoded, binaryEOP)
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("%d bytes of %#x: decoded %d bytes that don't match", length, fill, len(decoded))
+			}
+		}
+	}
+	data := testBinaryData()
+	if decoded := cobsDecode(cobsEncode(data, binaryEOP), binaryEOP); !bytes.Equal(decoded, data) {
+		t.Errorf("mixed data doesn't survive encoding")
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	store := &testBinaryStore{}
+	context := newTestBinaryContext(store)
+	data := testBinaryData()
+	err := context.BinaryTransmit(data, BinaryOptions{})
+	if err != nil {
+		t.Fatalf("transmit: %s", err)
+	}
+	if !bytes.Equal(store.data, data) {
+		t.Fatalf("the card received %d bytes that don't match", len(store.data))
+	}
+	received, err := context.BinaryReceive(0, len(data), BinaryOptions{})
+	if err != nil {
+		t.Fatalf("receive: %s", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes that don't match", len(received))
+	}
+	if context.resetRequired {
+		t.Errorf("a successful transfer should not require a reset")
+	}
+}
+
+func TestBinaryRoundTripWithoutCOBS(t *testing.T) {
+	store := &testBinaryStore{}
+	context := newTestBinaryContext(store)
+	data := []byte("no newlines here\x00\x01")
+	err := context.BinaryTransmit(data, BinaryOptions{NoCOBS: true})
+	if err != nil {
+		t.Fatalf("transmit: %s", err)
+	}
+	received, err := context.BinaryReceive(0, len(data), BinaryOptions{NoCOBS: true})
+	if err != nil {
+		t.Fatalf("receive: %s", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("expected %q, got %q", data, received)
+	}
+}
+
+func TestBinaryTransmitNewlineWithoutCOBS(t *testing.T) {
+	store := &testBinaryStore{}
+	context := newTestBinaryContext(store)
+	err := context.BinaryTransmit([]byte("line\n"), BinaryOptions{NoCOBS: true})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(store.data) != 0 {
+		t.Errorf("nothing should have been sent")
+	}
+}
+
+func TestBinaryTransmitRejected(t *testing.T) {
+	store := &testBinaryStore{}
+	context := newTestBinaryContext(store)
+	context.TransactionFn = func(context *Context, noResponse bool, reqJSON []byte) ([]byte, error) {
+
+		// Corrupt a byte of the data in transit
+		if noResponse && len(reqJSON) > 1 {
+			reqJSON = append([]byte{}, reqJSON...)
+			reqJSON[0]++
+		}
+		return store.respond(noResponse, reqJSON)
+	}
+	err := context.BinaryTransmit(testBinaryData(), BinaryOptions{})
+	if !errorHasCode(err, ErrCardIo) {
+		t.Errorf("expected an %s error, got %v", ErrCardIo, err)
+	}
+}
+
+func TestBinaryReceiveMD5Mismatch(t *testing.T) {
+	store := &testBinaryStore{data: testBinaryData(), corrupt: true}
+	context := newTestBinaryContext(store)
+	_, err := context.BinaryReceive(0, len(store.data), BinaryOptions{})
+	if !errorHasCode(err, ErrCardIo) {
+		t.Errorf("expected an %s error, got %v", ErrCardIo, err)
+	}
+	_, err = context.BinaryReceive(0, len(store.data), BinaryOptions{NoVerify: true})
+	if err != nil {
+		t.Errorf("unverified receive: %s", err)
+	}
+}
+
+func TestBinaryReceiveCardError(t *testing.T) {
+	store := &testBinaryStore{data: []byte("short")}
+	context := newTestBinaryContext(store)
+	_, err := context.BinaryReceive(0, 100, BinaryOptions{})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if context.resetRequired {
+		t.Errorf("an error reported by the card should not require a reset")
+	}
+}
+
+func TestBinaryRoundTripWithCRC(t *testing.T) {
+	store := &testBinaryStore{}
+	context := newTestBinaryContext(store)
+	context.EnableCRC(true)
+	data := testBinaryData()
+	err := context.BinaryTransmit(data, BinaryOptions{})
+	if err != nil {
+		t.Fatalf("transmit: %s", err)
+	}
+	received, err := context.BinaryReceive(0, len(data), BinaryOptions{})
+	if err != nil {
+		t.Fatalf("receive: %s", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes that don't match", len(received))
+	}
+	stats := context.Stats()
+	if stats.Transactions != 3 || stats.Errors != 0 {
+		t.Errorf("expected three successful transactions, got %+v", stats)
+	}
+}
+
+func TestBinaryResetFailure(t *testing.T) {
+	store := &testBinaryStore{data: testBinaryData()}
+	context := newTestBinaryContext(store)
+	sent := 0
+	context.TransactionFn = func(context *Context, noResponse bool, reqJSON []byte) ([]byte, error) {
+		sent++
+		return store.respond(noResponse, reqJSON)
+	}
+	context.ResetFn = func(context *Context) error {
+		return fmt.Errorf("reset failed %s", ErrCardIo)
+	}
+	context.resetRequired = true
+	err := context.BinaryTransmit([]byte("data"), BinaryOptions{})
+	if err == nil {
+		t.Errorf("transmit: expected the reset error")
+	}
+	context.resetRequired = true
+	_, err = context.BinaryReceive(0, 4, BinaryOptions{})
+	if err == nil {
+		t.Errorf("receive: expected the reset error")
+	}
+	if sent != 0 {
+		t.Errorf("nothing should be sent when the reset fails")
+	}
+}
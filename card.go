@@ -0,0 +1,938 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NoteTime converts epoch seconds as reported by the Notecard to a UTC time.Time, preserving
+// any fractional seconds.  Because the card reports 0 for an unknown time, 0 is converted to
+// the zero time.Time so that it may be tested with IsZero.
+func NoteTime(epochSecs float64) (t time.Time) {
+	if epochSecs == 0 {
+		return
+	}
+	secs := math.Floor(epochSecs)
+	return time.Unix(int64(secs), int64((epochSecs-secs)*1e9)).UTC()
+}
+
+// NoteEpoch converts a time.Time to epoch seconds as expected by the Notecard, truncating
+// any fractional seconds.  The zero time.Time is converted to 0.
+func NoteEpoch(t time.Time) (epochSecs int64) {
+	if t.IsZero() {
+		return
+	}
+	return t.Unix()
+}
+
+// CardTime returns the Notecard's notion of the current time, which it obtains from
+// the network or from GPS.  An error is returned if the card doesn't yet know the time.
+func (context *Context) CardTime() (t time.Time, err error) {
+	t, _, err = context.cardTime()
+	return
+}
+
+// Sources of the Notecard's time, as reported by CardTimeSource
+const (
+	TimeSourceGPS     = "gps"
+	TimeSourceCell    = "cell"
+	TimeSourceHost    = "host"
+	TimeSourceUnknown = "unknown"
+)
+
+// CardTimeSource returns the Notecard's notion of the current time along with the source from
+// which the card obtained it, so that an app requiring GPS-accurate time can reject time that
+// was merely set by a host.  The source is TimeSourceUnknown when the firmware doesn't report it.
+func (context *Context) CardTimeSource() (t time.Time, source string, err error) {
+
+	t, rsp, err := context.cardTime()
+	if err != nil {
+		return
+	}
+	switch stringField(rsp, "source") {
+	case TimeSourceGPS:
+		source = TimeSourceGPS
+	case TimeSourceCell:
+		source = TimeSourceCell
+	case TimeSourceHost:
+		source = TimeSourceHost
+	default:
+		source = TimeSourceUnknown
+	}
+
+	// Done
+	return
+
+}
+
+// CardTimeZone returns the Notecard's notion of the current time along with the name and
+// DST-adjusted UTC offset of the time zone in which the card is located, with t expressed in
+// that zone.  When the card doesn't know its location, the zone is reported as "UTC".
+func (context *Context) CardTimeZone() (t time.Time, zoneName string, offsetMins int, err error) {
+
+	t, rsp, err := context.cardTime()
+	if err != nil {
+		return
+	}
+
+	// The zone is reported as "<abbreviation>,<location>", such as "EDT,America/New_York"
+	zoneName = strings.SplitN(stringField(rsp, "zone"), ",", 2)[0]
+	if zoneName == "" || zoneName == "Unknown" {
+		zoneName = "UTC"
+	} else {
+		offsetMins = intField(rsp, "minutes")
+	}
+	t = t.In(time.FixedZone(zoneName, offsetMins*60))
+
+	// Done
+	return
+
+}
+
+// Get the current time and the full response from card.time
+func (context *Context) cardTime() (t time.Time, rsp map[string]interface{}, err error) {
+
+	rsp, err = context.Transaction(NewRequest("card.time"))
+	if err != nil {
+		return
+	}
+
+	epochSecs, present := numberField(rsp, "time")
+	if !present || epochSecs == 0 {
+		err = fmt.Errorf("card.time: time is not yet known")
+		return
+	}
+	t = NoteTime(epochSecs)
+
+	// Done
+	return
+
+}
+
+// SetTimeFromHost pushes the host's notion of the current time into the Notecard, which is
+// useful when the host has a more accurate clock than the card.  The card acknowledges the time
+// by reporting in its response that its source is now the host.  Firmware that doesn't support
+// setting the time either rejects the request or ignores it, reporting some other source, and
+// either case is returned as an error.
+func (context *Context) SetTimeFromHost(t time.Time) (err error) {
+
+	req := NewRequest("card.time")
+	req["time"] = NoteEpoch(t)
+	rsp, cardErr, err := context.transactionResult(req, TransactionOptions{})
+	if err != nil {
+		return
+	}
+	if cardErr != nil {
+		err = fmt.Errorf("card.time: setting the time is not supported by this firmware: %s", ErrorString(nil, rsp))
+		return
+	}
+	if stringField(rsp, "source") != TimeSourceHost {
+		err = fmt.Errorf("card.time: setting the time is not supported by this firmware")
+		return
+	}
+
+	// Done
+	return
+
+}
+
+// Periods that may be requested of card.usage.get
+const (
+	UsageTotal  = "total"
+	Usage1Hour  = "1hour"
+	Usage1Day   = "1day"
+	Usage30Days = "30day"
+)
+
+// Usage returns the Notecard's data usage accounting for the specified period mode,
+// which may be "" (equivalent to UsageTotal), Usage1Hour, Usage1Day, or Usage30Days.
+// The UsageBytesSent and related functions extract the commonly used counters.
+func (context *Context) Usage(mode string) (usage map[string]interface{}, err error) {
+
+	switch mode {
+	case "", UsageTotal, Usage1Hour, Usage1Day, Usage30Days:
+	default:
+		err = fmt.Errorf("card.usage.get: unrecognized mode: %s", mode)
+		return
+	}
+
+	req := NewRequest("card.usage.get")
+	if mode != "" {
+		req["mode"] = mode
+	}
+	usage, err = context.Transaction(req)
+
+	// Done
+	return
+
+}
+
+// UsageBytesSent returns the number of bytes sent from a card.usage.get response
+func UsageBytesSent(usage map[string]interface{}) int {
+	return intField(usage, "bytes_sent")
+}
+
+// UsageBytesReceived returns the number of bytes received from a card.usage.get response
+func UsageBytesReceived(usage map[string]interface{}) int {
+	return intField(usage, "bytes_received")
+}
+
+// UsageSessions returns the total number of standard and secure sessions from a card.usage.get response
+func UsageSessions(usage map[string]interface{}) int {
+	return intField(usage, "sessions_standard") + intField(usage, "sessions_secure")
+}
+
+// UsageDelta returns the bytes sent and received between two card.usage.get responses taken
+// with the same period mode.  If a counter went backwards, as when the card's counters were
+// reset between the two, its delta is returned as 0 because the usage can't be determined.
+func UsageDelta(before map[string]interface{}, after map[string]interface{}) (bytesTx int, bytesRx int) {
+	bytesTx = UsageBytesSent(after) - UsageBytesSent(before)
+	if bytesTx < 0 {
+		bytesTx = 0
+	}
+	bytesRx = UsageBytesReceived(after) - UsageBytesReceived(before)
+	if bytesRx < 0 {
+		bytesRx = 0
+	}
+	return
+}
+
+// Wireless returns the Notecard's card.wireless response, which describes the modem's
+// configuration and the network to which it is attached
+func (context *Context) Wireless() (rsp map[string]interface{}, err error) {
+	return context.Transaction(NewRequest("card.wireless"))
+}
+
+// WirelessAPN returns the configured APN along with the band currently in use, if known
+func (context *Context) WirelessAPN() (apn string, band string, err error) {
+
+	rsp, err := context.Wireless()
+	if err != nil {
+		return
+	}
+	apn = stringField(rsp, "apn")
+	net, _ := rsp["net"].(map[string]interface{})
+	band = stringField(net, "band")
+
+	// Done
+	return
+
+}
+
+// SignalHistory returns the recent history of signal strength readings that firmware supporting
+// it reports in the "history" field of card.wireless's network information, so that
+// connectivity quality can be trended over time.  An empty slice is returned by firmware that
+// does not report a history.
+func (context *Context) SignalHistory() (history []float64, err error) {
+
+	rsp, err := context.Wireless()
+	if err != nil {
+		return
+	}
+	net, _ := rsp["net"].(map[string]interface{})
+	history = floatArrayField(net, "history")
+	if history == nil {
+		history = []float64{}
+	}
+
+	// Done
+	return
+
+}
+
+// SetAPN configures the APN used by the modem, which is needed when using a private APN.
+// Specify "-" to revert to the APN of the embedded SIM.
+func (context *Context) SetAPN(apn string) (err error) {
+
+	// Validate the APN, whose network identifier is a set of dot-separated labels
+	if apn != "-" {
+		if len(apn) == 0 || len(apn) > 100 {
+			err = fmt.Errorf("card.wireless: APN must be 1-100 characters")
+			return
+		}
+		for _, label := range strings.Split(apn, ".") {
+			if label == "" {
+				err = fmt.Errorf("card.wireless: APN has an empty label: %s", apn)
+				return
+			}
+			for _, c := range label {
+				if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+					err = fmt.Errorf("card.wireless: APN contains invalid character '%c': %s", c, apn)
+					return
+				}
+			}
+		}
+	}
+
+	// Set it
+	req := NewRequest("card.wireless")
+	req["apn"] = apn
+	err = context.Request(req)
+	if err != nil {
+		return
+	}
+
+	// Confirm that it took effect
+	if apn != "-" {
+		var configured string
+		configured, _, err = context.WirelessAPN()
+		if err != nil {
+			return
+		}
+		if !strings.EqualFold(configured, apn) {
+			err = fmt.Errorf("card.wireless: APN is %s after setting it to %s", configured, apn)
+			return
+		}
+	}
+
+	// Done
+	return
+
+}
+
+// Motion returns the number of motion events sensed by the Notecard's accelerometer since the
+// last card.motion request, the movements string summarizing motion by time bucket, and the
+// time of the most recent motion.  Zero values are returned along with the card's error on
+// models that have no accelerometer.
+func (context *Context) Motion() (count int, movements string, when time.Time, err error) {
+
+	rsp, err := context.Transaction(NewRequest("card.motion"))
+	if err != nil {
+		err = fmt.Errorf("card.motion: motion is not available: %s", err)
+		return
+	}
+
+	count = intField(rsp, "count")
+	movements = stringField(rsp, "movements")
+	epochSecs, _ := numberField(rsp, "motion")
+	when = NoteTime(epochSecs)
+
+	// Done
+	return
+
+}
+
+// ParseDeviceUID splits a DeviceUID such as "dev:864475040536263" into its prefix and id,
+// returning ok only if it is well-formed: a lowercase alphabetic prefix and a hexadecimal id,
+// where an "imei" prefix additionally requires the 15-digit IMEI format.
+func ParseDeviceUID(s string) (prefix string, id string, ok bool) {
+
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return
+	}
+	for _, c := range parts[0] {
+		if c < 'a' || c > 'z' {
+			return
+		}
+	}
+	for _, c := range parts[1] {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return
+		}
+	}
+	if parts[0] == "imei" {
+		if len(parts[1]) != 15 || strings.IndexFunc(parts[1], func(c rune) bool { return c < '0' || c > '9' }) >= 0 {
+			return
+		}
+	}
+
+	// Done
+	return parts[0], parts[1], true
+
+}
+
+// LEDColors are the colors that may be specified to LED
+var LEDColors = []string{"red", "green", "blue", "yellow", "cyan", "magenta", "white"}
+
+// LED turns the Notecarrier's LED of the specified color on or off
+func (context *Context) LED(color string, on bool) (err error) {
+
+	supported := false
+	for _, c := range LEDColors {
+		if c == color {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		err = fmt.Errorf("card.led: unsupported color %q (must be one of %s)", color, strings.Join(LEDColors, ", "))
+		return
+	}
+
+	req := NewRequest("card.led")
+	req["mode"] = color
+	if on {
+		req["on"] = true
+	} else {
+		req["off"] = true
+	}
+	err = context.Request(req)
+
+	// Done
+	return
+
+}
+
+// SelfTest exercises the full transaction path with a sequence of diagnostic requests, returning
+// a report keyed by request type.  Each entry holds "ok", along with either the request's "rsp"
+// or its "err", so a failing subsystem doesn't prevent the others from being checked.  An error
+// is returned naming the requests that failed, if any.
+func (context *Context) SelfTest() (report map[string]interface{}, err error) {
+
+	report = map[string]interface{}{}
+	failed := []string{}
+	for _, reqType := range []string{"card.version", "card.status", "card.time", "card.voltage"} {
+		item := map[string]interface{}{}
+		rsp, err2 := context.Transaction(NewRequest(reqType))
+		if err2 != nil {
+			item["ok"] = false
+			item["err"] = err2.Error()
+			failed = append(failed, reqType)
+		} else {
+			item["ok"] = true
+			item["rsp"] = rsp
+		}
+		report[reqType] = item
+	}
+
+	if len(failed) > 0 {
+		err = fmt.Errorf("self-test: %d of %d checks failed: %s", len(failed), len(report), strings.Join(failed, ", "))
+	}
+
+	// Done
+	return
+
+}
+
+// CardTrace enables or disables the Notecard's own diagnostic trace output on the port in
+// use.  Set TraceFn to capture the trace lines, which would otherwise be mistaken for responses.
+func (context *Context) CardTrace(on bool) (err error) {
+	req := NewRequest("card.trace")
+	if on {
+		req["mode"] = "on"
+	} else {
+		req["mode"] = "off"
+	}
+	err = context.Request(req)
+	return
+}
+
+// PowerConfig returns the Notecard's card.power response, which reports the temperature,
+// voltage, and accumulated milliamp-hours measured by the power monitor
+func (context *Context) PowerConfig() (rsp map[string]interface{}, err error) {
+	return context.Transaction(NewRequest("card.power"))
+}
+
+// SetPowerConfig sets how often, in minutes, the power monitor takes a reading, with 0
+// leaving the interval unchanged, and optionally resets its accumulated milliamp-hours
+func (context *Context) SetPowerConfig(minutes int, reset bool) (err error) {
+
+	if minutes < 0 {
+		err = fmt.Errorf("card.power: minutes must not be negative (%d)", minutes)
+		return
+	}
+
+	req := NewRequest("card.power")
+	if minutes > 0 {
+		req["minutes"] = minutes
+	}
+	if reset {
+		req["reset"] = true
+	}
+	rsp, err := context.Transaction(req)
+	if err != nil {
+		return
+	}
+
+	// Confirm that the settings were applied, to the extent that the card reports them
+	reported, present := numberField(rsp, "minutes")
+	if minutes > 0 && present && int(reported) != minutes {
+		err = fmt.Errorf("card.power: interval is %d minutes after setting it to %d", int(reported), minutes)
+		return
+	}
+
+	// Done
+	return
+
+}
+
+// Status returns the Notecard's card.status response
+func (context *Context) Status() (rsp map[string]interface{}, err error) {
+	return context.Transaction(NewRequest("card.status"))
+}
+
+// StatusAlerts returns the alert conditions reported in a card.status response, or an empty
+// slice if there are none.  Alerts reported as a comma-separated string are split into their
+// individual conditions, and an alert reported only as a flag is returned as "alert".
+func StatusAlerts(status map[string]interface{}) (alerts []string) {
+	alerts = []string{}
+	if list, ok := status["alerts"].([]string); ok {
+		return append(alerts, list...)
+	}
+	switch alert := status["alert"].(type) {
+	case bool:
+		if alert {
+			alerts = append(alerts, "alert")
+		}
+	case string:
+		for _, condition := range strings.Split(alert, ",") {
+			condition = strings.TrimSpace(condition)
+			if condition != "" {
+				alerts = append(alerts, condition)
+			}
+		}
+	}
+	return
+}
+
+// StorageUsed returns the percentage of the Notecard's storage that is in use
+func (context *Context) StorageUsed() (percent int, err error) {
+	rsp, err := context.Status()
+	if err != nil {
+		return
+	}
+	percent = intField(rsp, "storage")
+	return
+}
+
+// Uptime returns how long the Notecard has been running, computed from the boot time reported
+// by card.status relative to the card's current time
+func (context *Context) Uptime() (uptime time.Duration, err error) {
+
+	rsp, err := context.Status()
+	if err != nil {
+		return
+	}
+	booted, present := numberField(rsp, "time")
+	if !present || booted == 0 {
+		err = fmt.Errorf("card.status: boot time not reported")
+		return
+	}
+	now, err := context.CardTime()
+	if err != nil {
+		return
+	}
+	uptime = now.Sub(NoteTime(booted))
+
+	// Done
+	return
+
+}
+
+// Connected returns whether the Notecard reports being connected to Notehub
+func (context *Context) Connected() (connected bool, err error) {
+	rsp, err := context.Status()
+	if err != nil {
+		return
+	}
+	connected = boolField(rsp, "connected")
+	return
+}
+
+// SinceLastSync returns how long it has been since the Notecard last completed a sync with
+// Notehub, which may be used to detect a device that is unable to connect.  An error is
+// returned if the card hasn't completed a sync since it booted.
+func (context *Context) SinceLastSync() (since time.Duration, err error) {
+
+	rsp, err := context.Transaction(NewRequest("hub.sync.status"))
+	if err != nil {
+		return
+	}
+
+	// Prefer the card's own measure of the elapsed time
+	completedSecs, present := numberField(rsp, "completed")
+	if present {
+		since = time.Duration(completedSecs) * time.Second
+		return
+	}
+
+	// Otherwise compute it from the time of the sync
+	syncedAt, present := numberField(rsp, "time")
+	if !present || syncedAt == 0 {
+		err = fmt.Errorf("hub.sync.status: no sync has completed")
+		return
+	}
+	now, err := context.CardTime()
+	if err != nil {
+		return
+	}
+	since = now.Sub(NoteTime(syncedAt))
+
+	// Done
+	return
+
+}
+
+// SupportedAPIs returns the request families that the Notecard reports supporting in the
+// "api" field of card.version.  An empty slice is returned for firmware that doesn't report
+// them, including firmware that reports only the version of its API as a number in that field,
+// which APIVersion returns.
+func (context *Context) SupportedAPIs() (apis []string, err error) {
+	rsp, err := context.Transaction(NewRequest("card.version"))
+	if err != nil {
+		return
+	}
+	apis = []string{}
+	switch v := rsp["api"].(type) {
+	case []string:
+		apis = append(apis, v...)
+	case []interface{}:
+		for i := range v {
+			if api, isString := v[i].(string); isString {
+				apis = append(apis, api)
+			}
+		}
+	}
+	return
+}
+
+// APIVersion returns the version of the request API that the Notecard reports as a number in
+// the "api" field of card.version, or 0 if it doesn't report one
+func (context *Context) APIVersion() (version int, err error) {
+	rsp, err := context.Transaction(NewRequest("card.version"))
+	if err != nil {
+		return
+	}
+	version = intField(rsp, "api")
+	return
+}
+
+// CardI2CAddress returns the I2C address that the card is configured to respond to, which
+// takes effect when the card restarts
+func (context *Context) CardI2CAddress() (addr uint16, err error) {
+	rsp, err := context.Transaction(NewRequest("card.io"))
+	if err != nil {
+		return
+	}
+	addr = uint16(intField(rsp, "i2c"))
+	if addr == 0 {
+		addr = DefaultI2CAddress
+	}
+	return
+}
+
+// SetCardI2CAddress configures the I2C address that the card responds to, or restores the
+// default if addr is 0.  Because the card continues to respond at its old address until it
+// restarts, this context continues to use the old address until a card.restart is performed
+// through it, after which it switches to the new address.  If the card is restarted by some
+// other means, use SetI2CAddress to switch.
+func (context *Context) SetCardI2CAddress(addr uint16) (err error) {
+
+	req := NewRequest("card.io")
+	if addr == 0 || addr == DefaultI2CAddress {
+		addr = DefaultI2CAddress
+		req["i2c"] = -1
+	} else {
+		req["i2c"] = addr
+	}
+	err = context.Request(req)
+	if err != nil {
+		return
+	}
+
+	transBegin(false)
+	context.i2cAddressPending = addr
+	transEnd()
+
+	// Done
+	return
+
+}
+
+// SetI2CAddress changes the address with which this context reaches the card, or restores the
+// default if addr is 0, cancelling any change pending from SetCardI2CAddress
+func (context *Context) SetI2CAddress(addr uint16) {
+	if addr == 0 {
+		addr = DefaultI2CAddress
+	}
+	transBegin(false)
+	context.i2cAddress = addr
+	context.i2cAddressPending = 0
+	transEnd()
+}
+
+// How long the card may continue to answer requests after being told to restart
+const restartSettleDelay = 1 * time.Second
+
+// How long to wait for the card to become ready after a restart
+const restartReadyTimeout = 30 * time.Second
+
+// Restart restarts the Notecard and waits for it to become ready.  A full restart reboots the
+// card with card.restart, which drops its network connection and any session with Notehub, and
+// typically takes several seconds.  A soft restart doesn't reboot the card, and so preserves
+// its connectivity state, but rather restarts the host's session with it: the port is reset,
+// draining any partial response and resynchronizing the request stream, after which the soft
+// restart completes as soon as the card answers.
+func (context *Context) Restart(full bool) (err error) {
+
+	if full {
+		_, err = context.transaction(NewRequest("card.restart"), TransactionOptions{noRestartDelay: true})
+		if err != nil {
+			return
+		}
+		time.Sleep(restartSettleDelay)
+	} else {
+		transBegin(false)
+		err = context.Reset()
+		transEnd()
+		if err != nil {
+			return
+		}
+	}
+	err = context.WaitReady(restartReadyTimeout)
+
+	// Done
+	return
+
+}
+
+// GPSStatus returns the Notecard's GPS mode, as configured by card.location.mode, and the number
+// of satellites in view as reported by card.location.  While the card is still acquiring a fix,
+// or when the GPS is off, the mode is returned with satellites of 0.
+func (context *Context) GPSStatus() (mode string, satellites int, err error) {
+
+	rsp, err := context.Transaction(NewRequest("card.location.mode"))
+	if err != nil {
+		return
+	}
+	mode = stringField(rsp, "mode")
+
+	rsp, err = context.Transaction(NewRequest("card.location"))
+	if err != nil {
+		return
+	}
+	satellites = gpsSatellites(stringField(rsp, "status"))
+
+	// Done
+	return
+
+}
+
+// Extract the satellites in view from a card.location status such as
+// "GPS search (111 sec, 32/33 dB SNR, 3/9 sats)", or 0 if not reported
+func gpsSatellites(status string) (satellites int) {
+	end := strings.Index(status, " sats")
+	if end < 0 {
+		return
+	}
+	start := strings.LastIndexAny(status[:end], " /") + 1
+	satellites, _ = strconv.Atoi(status[start:end])
+	return
+}
+
+// Sources of a location, as reported by Location
+const (
+	LocationSourceGPS          = "gps"
+	LocationSourceTower        = "tower"
+	LocationSourceTriangulated = "triangulated"
+)
+
+// Location returns the Notecard's most recent location along with its source, so that the
+// caller can judge its accuracy.  A GPS fix from card.location is preferred; when the card has
+// none, the location of the cell tower reported by card.time is returned instead.  An error is
+// returned if the card knows neither.
+func (context *Context) Location() (lat float64, lon float64, source string, err error) {
+
+	// Use the location from the card's own positioning, if it has one
+	rsp, err := context.Transaction(NewRequest("card.location"))
+	if err != nil {
+		return
+	}
+	var hasLat, hasLon bool
+	lat, hasLat = numberField(rsp, "lat")
+	lon, hasLon = numberField(rsp, "lon")
+	if hasLat && hasLon {
+		source = stringField(rsp, "source")
+		if source == "" {
+			source = LocationSourceGPS
+		}
+		return
+	}
+
+	// Fall back to the location of the tower
+	rsp, err = context.Transaction(NewRequest("card.time"))
+	if err != nil {
+		return
+	}
+	lat, hasLat = numberField(rsp, "lat")
+	lon, hasLon = numberField(rsp, "lon")
+	if !hasLat || !hasLon {
+		err = fmt.Errorf("card.location: location is not yet known")
+		return
+	}
+	source = LocationSourceTower
+
+	// Done
+	return
+
+}
+
+// FirmwareVersion returns the major, minor, and patch numbers of the Notecard's firmware version
+func (context *Context) FirmwareVersion() (major int, minor int, patch int, err error) {
+	rsp, err := context.Transaction(NewRequest("card.version"))
+	if err != nil {
+		return
+	}
+	body, _ := rsp["body"].(map[string]interface{})
+	if _, present := numberField(body, "ver_major"); !present {
+		err = fmt.Errorf("card.version: firmware version not reported")
+		return
+	}
+	major = intField(body, "ver_major")
+	minor = intField(body, "ver_minor")
+	patch = intField(body, "ver_patch")
+	return
+}
+
+// FirmwareAtLeast returns whether the Notecard's firmware version, as reported by card.version,
+// is at least the specified version, which is compared as by CompareFirmwareVersions
+func (context *Context) FirmwareAtLeast(version string) (atLeast bool, err error) {
+	rsp, err := context.Transaction(NewRequest("card.version"))
+	if err != nil {
+		return
+	}
+	current := stringField(rsp, "version")
+	if current == "" {
+		err = fmt.Errorf("card.version: firmware version not reported")
+		return
+	}
+	atLeast = CompareFirmwareVersions(current, version) >= 0
+	return
+}
+
+// CompareFirmwareVersions compares two firmware version strings, returning -1 if a is earlier
+// than b, 0 if they are the same, or 1 if a is later than b.  Any prefix preceding the first
+// digit, such as "notecard-", is ignored, and numeric components are compared numerically
+// with missing components treated as 0, so that "5.3.1.16294" is later than "5.3" and
+// "5.10" is later than "5.9".  As with semantic versioning, a pre-release suffix beginning
+// with '-' makes a version earlier than the same version without one, and a build suffix
+// beginning with '+' is ignored.
+func CompareFirmwareVersions(a string, b string) int {
+
+	aNumbers, aPre := parseFirmwareVersion(a)
+	bNumbers, bPre := parseFirmwareVersion(b)
+
+	// Compare the numeric components
+	for i := 0; i < len(aNumbers) || i < len(bNumbers); i++ {
+		var aNumber, bNumber int
+		if i < len(aNumbers) {
+			aNumber = aNumbers[i]
+		}
+		if i < len(bNumbers) {
+			bNumber = bNumbers[i]
+		}
+		if aNumber < bNumber {
+			return -1
+		}
+		if aNumber > bNumber {
+			return 1
+		}
+	}
+
+	// A pre-release precedes the release
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	case aPre < bPre:
+		return -1
+	}
+	return 1
+
+}
+
+// Split a firmware version into its numeric components and its pre-release suffix
+func parseFirmwareVersion(version string) (numbers []int, preRelease string) {
+
+	// Skip any prefix, and discard any build suffix
+	start := strings.IndexAny(version, "0123456789")
+	if start < 0 {
+		return
+	}
+	version = version[start:]
+	if plus := strings.IndexByte(version, '+'); plus >= 0 {
+		version = version[:plus]
+	}
+	if dash := strings.IndexByte(version, '-'); dash >= 0 {
+		preRelease = version[dash+1:]
+		version = version[:dash]
+	}
+
+	// Parse the components, stopping at anything that isn't numeric
+	for _, component := range strings.Split(version, ".") {
+		number, err := strconv.Atoi(component)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, number)
+	}
+
+	// Done
+	return
+
+}
+
+// OptimalPacing chooses the segment length and delay with which requests are transmitted, and
+// on I2C the chunk length, according to the interface on which the context was opened, which
+// is what Identify reports unless the context has a Name.  It sets the context's
+// RequestSegmentMaxLen and RequestSegmentDelayMs, which take precedence over the deprecated
+// package variables of the same names.  The values chosen are:
+//
+//	interface  segment length  segment delay  I2C chunk
+//	i2c        250             250ms          253
+//	uart       250             250ms          -
+//
+// The segment length and delay are those with which note-c paces requests, which the card's
+// receive buffer is known to keep up with on every firmware version, and the I2C chunk is the
+// largest that fits in a single 255-byte I2C read along with its header.
+func (context *Context) OptimalPacing() {
+	transBegin(false)
+	if context.interfaceName == "i2c" {
+		context.RequestSegmentMaxLen = CardRequestI2CSegmentMaxLen
+		context.RequestSegmentDelayMs = CardRequestI2CSegmentDelayMs
+		context.pacingI2CChunkLen = CardI2CMax
+	} else {
+		context.RequestSegmentMaxLen = CardRequestSerialSegmentMaxLen
+		context.RequestSegmentDelayMs = CardRequestSerialSegmentDelayMs
+	}
+	transEnd()
+}
+
+// AuxSerial configures the Notecard's AUX serial port with card.aux.serial, setting its mode,
+// such as "req" to accept requests from another device or "notify" to stream notifications
+// to it, and its baud rate, or the card's default rate if rate is 0.  The card doesn't support
+// a transparent passthrough, so bytes can't be sent or received through the AUX port; a device
+// on it exchanges only JSON requests, responses, and notifications with the card.
+func (context *Context) AuxSerial(mode string, rate int) (err error) {
+	req := NewRequest("card.aux.serial")
+	if mode != "" {
+		req["mode"] = mode
+	}
+	if rate > 0 {
+		req["rate"] = rate
+	}
+	err = context.Request(req)
+	return
+}
+
+// AuxSerialConfig returns the mode and baud rate of the Notecard's AUX serial port
+func (context *Context) AuxSerialConfig() (mode string, rate int, err error) {
+	rsp, err := context.Transaction(NewRequest("card.aux.serial"))
+	if err != nil {
+		return
+	}
+	mode = stringField(rsp, "mode")
+	rate = intField(rsp, "rate")
+	return
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptimalPacing(t *testing.T) {
+	uart, _ := OpenUART(nil, nil)
+	i2c, _ := OpenI2C(0, nil)
+	for _, context := range []*Context{uart, i2c} {
+		context.Name = "sensors"
+		context.RequestSegmentMaxLen, context.RequestSegmentDelayMs = 1024, 5
+		context.OptimalPacing()
+		maxLen, delayMs := context.requestSegmentParams(0, 0)
+		if maxLen != 250 || delayMs != 250 {
+			t.Errorf("%s: expected 250-byte segments 250ms apart, got %d and %dms", context.interfaceName, maxLen, delayMs)
+		}
+	}
+	if uart.pacingI2CChunkLen != 0 {
+		t.Errorf("uart: no I2C chunk length should be chosen, got %d", uart.pacingI2CChunkLen)
+	}
+	if i2c.i2cChunkMax() != CardI2CMax {
+		t.Errorf("i2c: expected %d-byte chunks, got %d", CardI2CMax, i2c.i2cChunkMax())
+	}
+}
+
+func TestSetTimeFromHost(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		rspJSON   string
+		supported bool
+	}{
+		{fmt.Sprintf("{\"time\":%d,\"source\":\"host\"}\n", now.Unix()), true},
+		{fmt.Sprintf("{\"time\":%d,\"source\":\"gps\"}\n", now.Unix()), false},
+		{fmt.Sprintf("{\"time\":%d}\n", now.Unix()), false},
+		{"{\"err\":\"card.time: unknown argument: time\"}\n", false},
+	}
+	for _, test := range tests {
+		var req map[string]interface{}
+		context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+			req, _ = JSONToObject(reqJSON)
+			return []byte(test.rspJSON), nil
+		})
+		err := context.SetTimeFromHost(now)
+		if intField(req, "time") != int(now.Unix()) {
+			t.Errorf("expected the time %d to be sent, got %v", now.Unix(), req["time"])
+		}
+		if test.supported && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.rspJSON, err)
+		}
+		if !test.supported && (err == nil || !strings.Contains(err.Error(), "not supported")) {
+			t.Errorf("%s: expected an unsupported error, got %v", test.rspJSON, err)
+		}
+	}
+}
+
+func TestSetTimeFromHostTransportError(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return nil, fmt.Errorf("write failed %s", ErrCardIo)
+	})
+	err := context.SetTimeFromHost(time.Now())
+	if !errorHasCode(err, ErrCardIo) || strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected the transport error, got %v", err)
+	}
+}
+
+// A card.version response as reported by a Notecard
+const testCardVersionJSON = `{"version":"notecard-5.3.1.16293","device":"dev:864475046552567","name":"Blues Wireless Notecard","sku":"NOTE-WBNA-500","board":"1.11","api":5,"body":{"org":"Blues Wireless","product":"Notecard","version":"notecard-5.3.1","ver_major":5,"ver_minor":3,"ver_patch":1,"ver_build":16293,"built":"Sep  7 2023 15:28:07"}}` + "\n"
+
+func TestSupportedAPIs(t *testing.T) {
+	tests := []struct {
+		rspJSON string
+		apis    string
+		version int
+	}{
+		{testCardVersionJSON, "", 5},
+		{"{\"version\":\"notecard-9.1.1\",\"api\":[\"card\",\"hub\",\"note\"]}\n", "card,hub,note", 0},
+		{"{\"version\":\"notecard-9.1.1\",\"api\":[\"card\",7,null]}\n", "card", 0},
+		{"{\"version\":\"notecard-1.5.0\"}\n", "", 0},
+	}
+	for _, test := range tests {
+		context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+			return []byte(test.rspJSON), nil
+		})
+		apis, err := context.SupportedAPIs()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if apis == nil || strings.Join(apis, ",") != test.apis {
+			t.Errorf("%s: expected [%s], got %#v", test.rspJSON, test.apis, apis)
+		}
+		version, err := context.APIVersion()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if version != test.version {
+			t.Errorf("%s: expected API version %d, got %d", test.rspJSON, test.version, version)
+		}
+	}
+}
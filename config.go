@@ -0,0 +1,129 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExportConfig returns the context's tunable settings as an object that may be encoded as JSON
+// and stored, such as in an environment variable or in flash, to be restored with ImportConfig.
+// Durations are expressed in milliseconds.  The I/O functions and callbacks are not included.
+func (context *Context) ExportConfig() (config map[string]interface{}) {
+
+	transBegin(false)
+	config = map[string]interface{}{
+		"disable_ua":                    context.DisableUA,
+		"max_response_bytes":            context.MaxResponseBytes,
+		"drain_on_corruption":           context.DrainOnCorruption,
+		"env_flush_interval_ms":         durationMs(context.EnvFlushInterval),
+		"auto_sync_storage_threshold":   context.AutoSyncStorageThreshold,
+		"auto_sync_storage_check_every": context.AutoSyncStorageCheckEvery,
+		"min_transaction_interval_ms":   durationMs(context.MinTransactionInterval),
+		"auto_backoff":                  context.AutoBackoff,
+		"rate_limit":                    context.RateLimit,
+		"rate_limit_burst":              context.RateLimitBurst,
+		"rate_limit_error":              context.RateLimitError,
+		"reopen_backoff_min_ms":         durationMs(context.ReopenBackoffMin),
+		"reopen_backoff_max_ms":         durationMs(context.ReopenBackoffMax),
+		"segment_max_len":               context.RequestSegmentMaxLen,
+		"segment_delay_ms":              context.RequestSegmentDelayMs,
+		"i2c_chunk_len":                 context.pacingI2CChunkLen,
+		"retry_max":                     context.RetryPolicy.MaxRetries,
+		"retry_backoff_ms":              context.RetryPolicy.BackoffMs,
+		"retry_timeout_ms":              durationMs(context.RetryPolicy.TotalTimeout),
+	}
+	transEnd()
+
+	// Done
+	return
+
+}
+
+// ImportConfig applies settings previously returned by ExportConfig.  Settings that are absent
+// are left unchanged, and unrecognized settings are ignored so that a configuration saved by
+// another version of this package can be applied.  Nothing is changed if any setting is invalid.
+func (context *Context) ImportConfig(config map[string]interface{}) (err error) {
+
+	// Validate the types of all settings before applying any of them
+	for k, v := range config {
+		switch k {
+		case "disable_ua", "drain_on_corruption", "auto_backoff", "rate_limit_error":
+			if _, ok := v.(bool); !ok {
+				err = fmt.Errorf("config: %s must be a boolean", k)
+				return
+			}
+		case "max_response_bytes", "env_flush_interval_ms", "auto_sync_storage_threshold",
+			"auto_sync_storage_check_every", "min_transaction_interval_ms", "rate_limit",
+			"rate_limit_burst", "reopen_backoff_min_ms", "reopen_backoff_max_ms",
+			"i2c_chunk_len", "retry_max", "retry_backoff_ms", "retry_timeout_ms":
+			if f, present := numberField(config, k); !present || f < 0 {
+				err = fmt.Errorf("config: %s must be a non-negative number", k)
+				return
+			}
+		case "segment_max_len", "segment_delay_ms":
+			if f, present := numberField(config, k); !present || (f < 0 && f != RequestSegmentDefault) {
+				err = fmt.Errorf("config: %s must be a non-negative number or %d for the default", k, RequestSegmentDefault)
+				return
+			}
+		}
+	}
+
+	// Apply those that are present
+	transBegin(false)
+	importBool(config, "disable_ua", &context.DisableUA)
+	importInt(config, "max_response_bytes", &context.MaxResponseBytes)
+	importBool(config, "drain_on_corruption", &context.DrainOnCorruption)
+	importDuration(config, "env_flush_interval_ms", &context.EnvFlushInterval)
+	importInt(config, "auto_sync_storage_threshold", &context.AutoSyncStorageThreshold)
+	importInt(config, "auto_sync_storage_check_every", &context.AutoSyncStorageCheckEvery)
+	importDuration(config, "min_transaction_interval_ms", &context.MinTransactionInterval)
+	importBool(config, "auto_backoff", &context.AutoBackoff)
+	if f, present := numberField(config, "rate_limit"); present {
+		context.RateLimit = f
+	}
+	importInt(config, "rate_limit_burst", &context.RateLimitBurst)
+	importBool(config, "rate_limit_error", &context.RateLimitError)
+	importDuration(config, "reopen_backoff_min_ms", &context.ReopenBackoffMin)
+	importDuration(config, "reopen_backoff_max_ms", &context.ReopenBackoffMax)
+	importInt(config, "segment_max_len", &context.RequestSegmentMaxLen)
+	importInt(config, "segment_delay_ms", &context.RequestSegmentDelayMs)
+	importInt(config, "i2c_chunk_len", &context.pacingI2CChunkLen)
+	importInt(config, "retry_max", &context.RetryPolicy.MaxRetries)
+	importInt(config, "retry_backoff_ms", &context.RetryPolicy.BackoffMs)
+	importDuration(config, "retry_timeout_ms", &context.RetryPolicy.TotalTimeout)
+	transEnd()
+
+	// Done
+	return
+
+}
+
+// Express a duration in whole milliseconds
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// Apply a boolean setting if present
+func importBool(config map[string]interface{}, field string, value *bool) {
+	if b, ok := config[field].(bool); ok {
+		*value = b
+	}
+}
+
+// Apply an integer setting if present
+func importInt(config map[string]interface{}, field string, value *int) {
+	if f, present := numberField(config, field); present {
+		*value = int(f)
+	}
+}
+
+// Apply a duration setting, expressed in milliseconds, if present
+func importDuration(config map[string]interface{}, field string, value *time.Duration) {
+	if f, present := numberField(config, field); present {
+		*value = time.Duration(f) * time.Millisecond
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+// The field with which a request or response is protected: ,"crc":"SSSS:CCCCCCCC" where SSSS
+// is the hex sequence number of the request and CCCCCCCC is the hex CRC32 of the JSON without
+// the field.  A retried request carries the same sequence number, so that the card can tell
+// that it has already been performed and need only repeat its response.
+const crcFieldName = "\"crc\":\""
+const crcFieldLen = 22
+
+// The number of times a transaction is retried when its response fails the CRC check
+const crcRetriesMax = 3
+
+// EnableCRC protects requests and responses with a CRC, so that corruption on a noisy link is
+// detected and the transaction retried, rather than resulting in a garbled response.  Firmware
+// that doesn't support CRCs ignores the field in the request and omits it from the response.
+func (context *Context) EnableCRC(enabled bool) {
+	transBegin(false)
+	context.crcEnabled = enabled
+	transEnd()
+}
+
+// Perform a transaction protected by a CRC, retrying it if the response is corrupt
+func (context *Context) transactionCRC(noResponse bool, reqJSON []byte) (rspJSON []byte, err error) {
+
+	context.crcSeq++
+	crcJSON := append(crcAdd(bytes.TrimRight(reqJSON, "\r\n"), context.crcSeq), '\n')
+	for retries := 0; ; retries++ {
+		rspJSON, err = context.TransactionFn(context, noResponse, crcJSON)
+		if err != nil || noResponse {
+			return
+		}
+		rspJSON, err = crcCheck(rspJSON, context.crcSeq)
+		if err == nil || retries >= crcRetriesMax {
+			return
+		}
+		context.cardReportError(err)
+	}
+
+}
+
+// Append the CRC field to a request, which must be a JSON object without a trailing newline
+func crcAdd(reqJSON []byte, seq uint16) (crcJSON []byte) {
+	separator := ","
+	if len(bytes.TrimSpace(reqJSON[:len(reqJSON)-1])) == 1 {
+		separator = ""
+	}
+	crcJSON = make([]byte, 0, len(reqJSON)+crcFieldLen)
+	crcJSON = append(crcJSON, reqJSON[:len(reqJSON)-1]...)
+	crcJSON = append(crcJSON, fmt.Sprintf("%s%s%04X:%08X\"}", separator, crcFieldName, seq, crc32.ChecksumIEEE(reqJSON))...)
+	return
+}
+
+// Verify and remove the CRC field of a response, if it has one, returning an I/O error if the
+// response is not the reply to the request with the specified sequence number or is corrupt
+func crcCheck(rspJSON []byte, seq uint16) (checkedJSON []byte, err error) {
+
+	// A response without the field is passed through unchecked
+	checkedJSON = rspJSON
+	body := bytes.TrimRight(rspJSON, "\r\n")
+	off := len(body) - 1 - crcFieldLen
+	if off < 0 || body[len(body)-1] != '}' || !bytes.HasPrefix(body[off+1:], []byte(crcFieldName)) {
+		return
+	}
+	field := body[off+1+len(crcFieldName) : len(body)-2]
+	if len(field) != 13 || field[4] != ':' {
+		return
+	}
+	rspSeq, err1 := strconv.ParseUint(string(field[0:4]), 16, 16)
+	rspCRC, err2 := strconv.ParseUint(string(field[5:13]), 16, 32)
+	if err1 != nil || err2 != nil {
+		err = fmt.Errorf("malformed response CRC %s", ErrCardIo)
+		return
+	}
+
+	// Remove the field, and its separator if it isn't the only field, to verify the remainder
+	cut := off
+	if body[off] != ',' {
+		cut = off + 1
+	}
+	checkedJSON = append(body[:cut], '}')
+	if uint32(rspCRC) != crc32.ChecksumIEEE(checkedJSON) {
+		err = fmt.Errorf("response CRC mismatch %s", ErrCardIo)
+		return
+	}
+	if uint16(rspSeq) != seq {
+		err = fmt.Errorf("response sequence number %d doesn't match request %d %s", rspSeq, seq, ErrCardIo)
+		return
+	}
+	checkedJSON = append(checkedJSON, '\n')
+
+	// Done
+	return
+
+}
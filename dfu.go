@@ -0,0 +1,70 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import "time"
+
+// How often the card is checked for having completed a firmware update
+const dfuPollInterval = 5 * time.Second
+
+// Phases of a firmware update, as reported by DFUPhase
+const (
+	DFUPhaseIdle        = "idle"
+	DFUPhaseError       = "error"
+	DFUPhaseDownloading = "downloading"
+	DFUPhaseReady       = "ready"
+	DFUPhaseCompleted   = "completed"
+)
+
+// DFUPhase returns the phase of the Notecard's own firmware update, along with the card's
+// human-readable description of its progress
+func (context *Context) DFUPhase() (phase string, status string, err error) {
+
+	req := NewRequest("dfu.status")
+	req["name"] = "card"
+	rsp, err := context.Transaction(req)
+	if err != nil {
+		return
+	}
+	phase = stringField(rsp, "mode")
+	if phase == "" {
+		phase = DFUPhaseIdle
+	}
+	status = stringField(rsp, "status")
+
+	// Done
+	return
+
+}
+
+// InDFU returns true while the Notecard is downloading or about to install a firmware update,
+// during which the card may reject or delay requests and so telemetry should be paused
+func (context *Context) InDFU() (inDFU bool, err error) {
+	phase, _, err := context.DFUPhase()
+	if err != nil {
+		return
+	}
+	inDFU = phase == DFUPhaseDownloading || phase == DFUPhaseReady
+	return
+}
+
+// Wait until the card has completed its firmware update, returning false if the deadline
+// passes first
+func (context *Context) waitDFU(deadline time.Time) (completed bool) {
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false
+		}
+		if wait > dfuPollInterval {
+			wait = dfuPollInterval
+		}
+		time.Sleep(wait)
+		inDFU, err := context.InDFU()
+		if err == nil && !inDFU {
+			return true
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"time"
+)
+
+// EnvSet sets the value of an environment variable on the Notecard
+func (context *Context) EnvSet(name string, value string) (err error) {
+	req := NewRequest("env.set")
+	req["name"] = name
+	req["text"] = value
+	err = context.Request(req)
+	return
+}
+
+// EnvDefault sets the default value of an environment variable on the Notecard.  Unlike a value
+// set by EnvSet, which takes precedence over the values set for the device, project, and fleet
+// on Notehub, a default is used only when the variable isn't set in any of those places, so it
+// is suited to a value built into the host firmware that should never override configuration
+// made from Notehub.  An empty value removes the default.
+func (context *Context) EnvDefault(name string, value string) (err error) {
+	req := NewRequest("env.default")
+	req["name"] = name
+	req["text"] = value
+	err = context.Request(req)
+	return
+}
+
+// EnvSetBuffered records an environment variable to be set on the Notecard by the next EnvFlush,
+// which happens automatically after EnvFlushInterval if non-zero, and upon Close.  Setting the
+// same variable repeatedly before a flush results in only its final value being sent.  Note
+// that env.set accepts a single variable, so a flush performs one request per distinct name.
+func (context *Context) EnvSetBuffered(name string, value string) {
+	context.envLock.Lock()
+	if context.envPending == nil {
+		context.envPending = map[string]string{}
+	}
+	context.envPending[name] = value
+	if context.EnvFlushInterval > 0 && context.envTimer == nil {
+		context.envTimer = time.AfterFunc(context.EnvFlushInterval, func() {
+			context.EnvFlush()
+		})
+	}
+	context.envLock.Unlock()
+}
+
+// EnvFlush sets all environment variables buffered by EnvSetBuffered.  Variables that
+// fail to be set remain buffered for the next flush, and the first error is returned.
+func (context *Context) EnvFlush() (err error) {
+
+	// Take ownership of what's pending
+	context.envLock.Lock()
+	pending := context.envPending
+	context.envPending = nil
+	if context.envTimer != nil {
+		context.envTimer.Stop()
+		context.envTimer = nil
+	}
+	context.envLock.Unlock()
+
+	// Set each, putting back those that fail unless they've since been superseded
+	for name, value := range pending {
+		err2 := context.EnvSet(name, value)
+		if err2 == nil {
+			continue
+		}
+		if err == nil {
+			err = err2
+		}
+		context.envLock.Lock()
+		if context.envPending == nil {
+			context.envPending = map[string]string{}
+		}
+		if _, superseded := context.envPending[name]; !superseded {
+			context.envPending[name] = value
+		}
+		context.envLock.Unlock()
+	}
+
+	// Done
+	return
+
+}
@@ -4,5 +4,5 @@ go 1.16
 
 require (
 	github.com/mailru/easyjson v0.7.7 // indirect
-	github.com/valyala/fastjson v1.6.3 // indirect
+	github.com/valyala/fastjson v1.6.3
 )
@@ -0,0 +1,182 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// StartPeriodicSync starts a goroutine that issues a hub.sync every interval, randomly
+// displaced by up to +/- jitter so that a fleet of devices doesn't sync in lockstep.
+// The returned function stops the goroutine, waiting for any sync in progress to complete.
+func (context *Context) StartPeriodicSync(interval, jitter time.Duration) (stop func()) {
+
+	// Never allow the jitter to make the period negative
+	if jitter < 0 {
+		jitter = -jitter
+	}
+	if jitter > interval {
+		jitter = interval
+	}
+
+	// Sync until told to stop
+	stop = startPoller(func() time.Duration {
+		period := interval
+		if jitter > 0 {
+			period += time.Duration(rand.Int63n(int64(2*jitter)+1)) - jitter
+		}
+		return period
+	}, func() {
+		err := context.Request(NewRequest("hub.sync"))
+		if err != nil {
+			context.cardReportError(err)
+		}
+	})
+
+	// Done
+	return
+
+}
+
+// Start a goroutine that calls pollFn after each period returned by periodFn, returning a
+// function that stops the goroutine, waiting for any poll in progress to complete
+func startPoller(periodFn func() time.Duration, pollFn func()) (stop func()) {
+
+	// Run the poll loop until told to stop
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	go func() {
+		defer close(doneChan)
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-time.After(periodFn()):
+			}
+			pollFn()
+		}
+	}()
+
+	// Stop the goroutine exactly once, no matter how many times we're called
+	var stopOnce sync.Once
+	stop = func() {
+		stopOnce.Do(func() {
+			close(stopChan)
+			<-doneChan
+		})
+	}
+
+	// Done
+	return
+
+}
+
+// CommissioningMode places the Notecard into continuous mode with immediate sync, so that
+// configuration can be pushed quickly during factory bring-up.  The prior mode and sync
+// settings are remembered and are restored when commissioning mode is turned off.
+func (context *Context) CommissioningMode(on bool) (err error) {
+
+	// Turning it off restores the prior settings, if we changed them
+	if !on {
+		if context.commissioningPrior == nil {
+			return
+		}
+		req := NewRequest("hub.set")
+		for _, field := range []string{"mode", "outbound", "inbound"} {
+			if context.commissioningPrior[field] != nil {
+				req[field] = context.commissioningPrior[field]
+			}
+		}
+		req["sync"] = boolField(context.commissioningPrior, "sync")
+		err = context.Request(req)
+		if err != nil {
+			return
+		}
+		context.commissioningPrior = nil
+		return
+	}
+
+	// Remember the current settings, unless we've already done so
+	if context.commissioningPrior == nil {
+		var rsp map[string]interface{}
+		rsp, err = context.HubGet()
+		if err != nil {
+			return
+		}
+		if stringField(rsp, "mode") == "" {
+			err = fmt.Errorf("hub.get: current mode not reported")
+			return
+		}
+		context.commissioningPrior = rsp
+	}
+
+	// Stay connected, syncing as soon as anything changes
+	req := NewRequest("hub.set")
+	req["mode"] = "continuous"
+	req["sync"] = true
+	err = context.Request(req)
+
+	// Done
+	return
+
+}
+
+// HubGet returns the Notecard's complete hub.get configuration, so that it can be verified
+// after provisioning.  HubProduct and related functions extract the commonly used fields.
+func (context *Context) HubGet() (hub map[string]interface{}, err error) {
+	return context.Transaction(NewRequest("hub.get"))
+}
+
+// HubProduct returns the ProductUID from a hub.get response
+func HubProduct(hub map[string]interface{}) string {
+	return stringField(hub, "product")
+}
+
+// HubMode returns the connection mode, such as "periodic" or "continuous", from a hub.get response
+func HubMode(hub map[string]interface{}) string {
+	return stringField(hub, "mode")
+}
+
+// HubHost returns the Notehub host from a hub.get response
+func HubHost(hub map[string]interface{}) string {
+	return stringField(hub, "host")
+}
+
+// HubSerialNumber returns the device's serial number from a hub.get response
+func HubSerialNumber(hub map[string]interface{}) string {
+	return stringField(hub, "sn")
+}
+
+// HubDevice returns the DeviceUID from a hub.get response
+func HubDevice(hub map[string]interface{}) string {
+	return stringField(hub, "device")
+}
+
+// HubOutbound returns the outbound sync interval in minutes from a hub.get response
+func HubOutbound(hub map[string]interface{}) int {
+	return intField(hub, "outbound")
+}
+
+// HubInbound returns the inbound sync interval in minutes from a hub.get response
+func HubInbound(hub map[string]interface{}) int {
+	return intField(hub, "inbound")
+}
+
+// IsProvisioned returns whether the Notecard has been provisioned, which is to say that a
+// ProductUID has been configured with hub.set so that the card knows the Notehub project to
+// which it belongs.  A provisioned card may not yet have connected to Notehub; use
+// SinceLastSync to determine whether it has.  A card that has been restored to factory
+// settings with card.restore is no longer provisioned.
+func (context *Context) IsProvisioned() (provisioned bool, err error) {
+	hub, err := context.HubGet()
+	if err != nil {
+		return
+	}
+	provisioned = HubProduct(hub) != ""
+	return
+}
@@ -1,7 +1,11 @@
 package tinynote
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf16"
 
 	"github.com/valyala/fastjson"
 )
@@ -9,13 +13,19 @@ import (
 // Tracing during development
 const j2oTrace = false
 
+// StrictDecode causes JSONToObject to fail when it encounters an array that it can't represent,
+// such as one whose elements are of differing types, rather than omitting its nonconforming
+// elements.  This is useful when testing against specific firmware, so that structures the
+// decoder doesn't handle aren't masked.
+var StrictDecode = false
+
 // JSONToObject unmarshals the specified JSON and returns it as a map[string]interface{}
 func JSONToObject(objectJSON []byte) (object map[string]interface{}, err error) {
 
 	// Parse the input JSON
 	var p fastjson.Parser
 	var v *fastjson.Value
-	v, err = p.Parse(string(objectJSON))
+	v, err = p.Parse(string(decodeSurrogates(objectJSON)))
 	if err != nil {
 		return
 	}
@@ -28,14 +38,64 @@ func JSONToObject(objectJSON []byte) (object map[string]interface{}, err error)
 	}
 
 	object = map[string]interface{}{}
-	walkObjectInto(0, o, object)
+	err = walkObjectInto(0, o, object)
+	if err != nil {
+		object = nil
+	}
 
 	return
 
 }
 
+// Replace the \u escapes of surrogates within JSON with the characters that they represent,
+// decoding them as encoding/json does, because fastjson mishandles surrogates that aren't
+// correctly paired.  A surrogate pair such as \uD83D\uDE00 is replaced by the UTF-8 encoding of
+// the single character that it represents, and a surrogate that isn't part of a valid pair,
+// which represents no character, by U+FFFD, the replacement character.
+func decodeSurrogates(objectJSON []byte) []byte {
+	if !bytes.Contains(objectJSON, []byte("\\u")) {
+		return objectJSON
+	}
+	decoded := make([]byte, 0, len(objectJSON))
+	for i := 0; i < len(objectJSON); i++ {
+		c := objectJSON[i]
+		if c != '\\' || i+1 == len(objectJSON) {
+			decoded = append(decoded, c)
+			continue
+		}
+		r, ok := escapedRune(objectJSON, i)
+		if !ok || !utf16.IsSurrogate(r) {
+			// Leave any other escape, including an escaped backslash, to fastjson
+			decoded = append(decoded, c, objectJSON[i+1])
+			i++
+			continue
+		}
+		r2, ok := escapedRune(objectJSON, i+6)
+		if pair := utf16.DecodeRune(r, r2); ok && pair != unicode.ReplacementChar {
+			decoded = append(decoded, string(pair)...)
+			i += 11
+		} else {
+			decoded = append(decoded, string(unicode.ReplacementChar)...)
+			i += 5
+		}
+	}
+	return decoded
+}
+
+// Get the character of the \u escape at the specified offset, if there is one
+func escapedRune(objectJSON []byte, offset int) (r rune, ok bool) {
+	if offset+6 > len(objectJSON) || objectJSON[offset] != '\\' || objectJSON[offset+1] != 'u' {
+		return
+	}
+	u, err := strconv.ParseUint(string(objectJSON[offset+2:offset+6]), 16, 16)
+	if err != nil {
+		return
+	}
+	return rune(u), true
+}
+
 // Get a value
-func getValue(level int, v *fastjson.Value) (result interface{}) {
+func getValue(level int, v *fastjson.Value) (result interface{}, err error) {
 	switch v.Type() {
 	case fastjson.TypeTrue:
 		if j2oTrace {
@@ -53,6 +113,7 @@ func getValue(level int, v *fastjson.Value) (result interface{}) {
 		}
 		result = nil
 	case fastjson.TypeString:
+		// Escaped surrogates have already been decoded by decodeSurrogates
 		newStringBytes, _ := v.StringBytes()
 		newString := string(newStringBytes)
 		if j2oTrace {
@@ -60,6 +121,16 @@ func getValue(level int, v *fastjson.Value) (result interface{}) {
 		}
 		result = newString
 	case fastjson.TypeNumber:
+		// Integers are kept as int64 so that large ones, such as timestamps and 64-bit IDs,
+		// aren't rounded to the nearest float64
+		i, err2 := v.Int64()
+		if err2 == nil {
+			result = i
+			if j2oTrace {
+				fmt.Printf("INT %d\n", i)
+			}
+			break
+		}
 		f := v.GetFloat64()
 		result = f
 		if j2oTrace {
@@ -71,20 +142,20 @@ func getValue(level int, v *fastjson.Value) (result interface{}) {
 		}
 		o, _ := v.Object()
 		newObject := map[string]interface{}{}
-		walkObjectInto(level, o, newObject)
+		err = walkObjectInto(level, o, newObject)
 		result = newObject
 	case fastjson.TypeArray:
 		if j2oTrace {
 			fmt.Printf("ARRAY\n")
 		}
 		a, _ := v.Array()
-		result = walkArray(level, a)
+		result, err = walkArray(level, a)
 	}
 	return
 }
 
 // Walk an array into an object
-func walkArray(level int, a []*fastjson.Value) (array interface{}) {
+func walkArray(level int, a []*fastjson.Value) (array interface{}, err error) {
 
 	array = []interface{}{}
 	if a == nil {
@@ -94,7 +165,16 @@ func walkArray(level int, a []*fastjson.Value) (array interface{}) {
 		return
 	}
 
-	// We only support these array types
+	// A sparse array, in which some elements are null, can't be represented as a typed array
+	// without losing the positions of its elements, so decode each element with its own type
+	for i := 0; i < len(a); i++ {
+		if a[i].Type() == fastjson.TypeNull {
+			array, err = walkSparseArray(level, a)
+			return
+		}
+	}
+
+	// We only support these array types, whose elements must all be of the same type
 	switch a[0].Type() {
 	case fastjson.TypeString:
 		newArray := []string{}
@@ -104,11 +184,24 @@ func walkArray(level int, a []*fastjson.Value) (array interface{}) {
 					fmt.Printf("    ")
 				}
 			}
-			value := getValue(level+1, a[i])
+			if a[i].Type() != fastjson.TypeString {
+				if StrictDecode {
+					err = fmt.Errorf("array mixes element types %s and %s", fastjson.TypeString, a[i].Type())
+					return
+				}
+				continue
+			}
+			var value interface{}
+			value, err = getValue(level+1, a[i])
+			if err != nil {
+				return
+			}
 			newArray = append(newArray, value.(string))
 		}
 		array = newArray
 	case fastjson.TypeNumber:
+		// The array is of int64 if all of its elements are integers, or of float64 otherwise
+		newArrayInt := []int64{}
 		newArray := []float64{}
 		for i := 0; i < len(a); i++ {
 			if j2oTrace {
@@ -116,8 +209,55 @@ func walkArray(level int, a []*fastjson.Value) (array interface{}) {
 					fmt.Printf("    ")
 				}
 			}
-			value := getValue(level+1, a[i])
-			newArray = append(newArray, value.(float64))
+			if a[i].Type() != fastjson.TypeNumber {
+				if StrictDecode {
+					err = fmt.Errorf("array mixes element types %s and %s", fastjson.TypeNumber, a[i].Type())
+					return
+				}
+				continue
+			}
+			var value interface{}
+			value, err = getValue(level+1, a[i])
+			if err != nil {
+				return
+			}
+			switch n := value.(type) {
+			case int64:
+				if newArrayInt != nil {
+					newArrayInt = append(newArrayInt, n)
+				}
+				newArray = append(newArray, float64(n))
+			case float64:
+				newArrayInt = nil
+				newArray = append(newArray, n)
+			}
+		}
+		if newArrayInt != nil {
+			array = newArrayInt
+		} else {
+			array = newArray
+		}
+	case fastjson.TypeTrue, fastjson.TypeFalse:
+		newArray := []bool{}
+		for i := 0; i < len(a); i++ {
+			if j2oTrace {
+				for i := 0; i < level; i++ {
+					fmt.Printf("    ")
+				}
+			}
+			if a[i].Type() != fastjson.TypeTrue && a[i].Type() != fastjson.TypeFalse {
+				if StrictDecode {
+					err = fmt.Errorf("array mixes element types %s and %s", a[0].Type(), a[i].Type())
+					return
+				}
+				continue
+			}
+			var value interface{}
+			value, err = getValue(level+1, a[i])
+			if err != nil {
+				return
+			}
+			newArray = append(newArray, value.(bool))
 		}
 		array = newArray
 	case fastjson.TypeObject:
@@ -128,27 +268,257 @@ func walkArray(level int, a []*fastjson.Value) (array interface{}) {
 					fmt.Printf("    ")
 				}
 			}
-			value := getValue(level+1, a[i])
+			if a[i].Type() != fastjson.TypeObject {
+				if StrictDecode {
+					err = fmt.Errorf("array mixes element types %s and %s", fastjson.TypeObject, a[i].Type())
+					return
+				}
+				continue
+			}
+			var value interface{}
+			value, err = getValue(level+1, a[i])
+			if err != nil {
+				return
+			}
 			newArray = append(newArray, value.(map[string]interface{}))
 		}
 		array = newArray
+	case fastjson.TypeArray:
+		// Each element is decoded with its own type, which permits arbitrary nesting
+		newArray := []interface{}{}
+		for i := 0; i < len(a); i++ {
+			if j2oTrace {
+				for i := 0; i < level; i++ {
+					fmt.Printf("    ")
+				}
+			}
+			if a[i].Type() != fastjson.TypeArray {
+				if StrictDecode {
+					err = fmt.Errorf("array mixes element types %s and %s", fastjson.TypeArray, a[i].Type())
+					return
+				}
+				continue
+			}
+			var value interface{}
+			value, err = getValue(level+1, a[i])
+			if err != nil {
+				return
+			}
+			newArray = append(newArray, value)
+		}
+		array = newArray
+	default:
+		if StrictDecode {
+			err = fmt.Errorf("unsupported array element type: %s", a[0].Type())
+		}
 	}
 
 	// Done
 	return
 }
 
+// Walk an array containing nulls into an array of values of any type, in which each null
+// element is nil
+func walkSparseArray(level int, a []*fastjson.Value) (array []interface{}, err error) {
+	array = []interface{}{}
+	for i := 0; i < len(a); i++ {
+		if j2oTrace {
+			for i := 0; i < level; i++ {
+				fmt.Printf("    ")
+			}
+		}
+		var value interface{}
+		value, err = getValue(level+1, a[i])
+		if err != nil {
+			return
+		}
+		array = append(array, value)
+	}
+	return
+}
+
 // Decode an object
-func walkObjectInto(level int, o *fastjson.Object, object map[string]interface{}) {
+func walkObjectInto(level int, o *fastjson.Object, object map[string]interface{}) (err error) {
 	o.Visit(func(k []byte, v *fastjson.Value) {
+		if err != nil {
+			return
+		}
 		if j2oTrace {
 			for i := 0; i < level; i++ {
 				fmt.Printf("    ")
 			}
 			fmt.Printf("%s ", k)
 		}
-		value := getValue(level+1, v)
+		var value interface{}
+		value, err = getValue(level+1, v)
 		object[string(k)] = value
 	})
+	return
+}
+
+// Validate that the specified JSON is an object, returning an object containing only its "err"
+// and "id" fields and the specified fields, if present, so that the cost of decoding the
+// remainder is avoided
+func jsonFieldsOnly(objectJSON []byte, fields []string) (object map[string]interface{}, err error) {
+	var p fastjson.Parser
+	var v *fastjson.Value
+	v, err = p.ParseBytes(decodeSurrogates(objectJSON))
+	if err != nil {
+		return
+	}
+	_, err = v.Object()
+	if err != nil {
+		return
+	}
+	object = map[string]interface{}{}
+	for _, field := range append([]string{"err", "id"}, fields...) {
+		fv := v.Get(field)
+		if fv == nil {
+			continue
+		}
+		object[field], err = getValue(0, fv)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Get a numeric field from a decoded object, tolerating whichever numeric type it was decoded as
+func numberField(object map[string]interface{}, field string) (value float64, present bool) {
+	if object == nil {
+		return
+	}
+	return numberValue(object[field])
+}
+
+// Get the value of a number, tolerating whichever numeric type it was decoded as
+func numberValue(v interface{}) (value float64, isNumber bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	}
+	return
+}
+
+// Compare two scalar values, treating numbers as equal if they have the same value regardless
+// of the numeric type as which each was decoded or specified
+func valuesEqual(a interface{}, b interface{}) bool {
+	af, aIsNumber := numberValue(a)
+	bf, bIsNumber := numberValue(b)
+	if aIsNumber || bIsNumber {
+		return aIsNumber && bIsNumber && af == bf
+	}
+	switch a.(type) {
+	case nil, bool, string:
+		return a == b
+	}
+	return false
+}
+
+// Get a numeric array field from a decoded object, tolerating whichever numeric array type it
+// was decoded as, or nil if not present
+func floatArrayField(object map[string]interface{}, field string) (value []float64) {
+	if object == nil {
+		return
+	}
+	switch v := object[field].(type) {
+	case []float64:
+		value = v
+	case []int64:
+		value = make([]float64, len(v))
+		for i := range v {
+			value[i] = float64(v[i])
+		}
+	}
+	return
+}
+
+// Get an integer field from a decoded object, or 0 if not present
+func intField(object map[string]interface{}, field string) (value int) {
+	f, _ := numberField(object, field)
+	return int(f)
+}
+
+// Get a string field from a decoded object, or "" if not present
+func stringField(object map[string]interface{}, field string) (value string) {
+	if object == nil {
+		return
+	}
+	value, _ = object[field].(string)
+	return
+}
+
+// Get a boolean field from a decoded object, or false if not present
+func boolField(object map[string]interface{}, field string) (value bool) {
+	if object == nil {
+		return
+	}
+	value, _ = object[field].(bool)
+	return
+}
 
+// Determine whether a buffer holds a complete JSON object, with balanced braces and brackets
+// outside of strings, followed by nothing but whitespace
+func jsonComplete(buf []byte) bool {
+	depth := 0
+	inString := false
+	escaped := false
+	started := false
+	for _, c := range buf {
+		if started && depth == 0 {
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				return false
+			}
+			continue
+		}
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		case '{', '[':
+			if !started && c != '{' {
+				return false
+			}
+			started = true
+			depth++
+		case '}', ']':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		case '"':
+			if !started {
+				return false
+			}
+			inString = true
+		default:
+			if !started {
+				return false
+			}
+		}
+	}
+	return started && depth == 0
 }
@@ -0,0 +1,52 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Decode a string value, verifying that it matches what encoding/json decodes
+func testDecodeString(t *testing.T, valueJSON string, expected string) {
+	t.Helper()
+	objectJSON := `{"s":` + valueJSON + `}`
+	object, err := JSONToObject([]byte(objectJSON))
+	if err != nil {
+		t.Fatalf("decoding %s: %s", objectJSON, err)
+	}
+	actual := stringField(object, "s")
+	if actual != expected {
+		t.Errorf("decoding %s: expected %q, got %q", valueJSON, expected, actual)
+	}
+	var reference string
+	err = json.Unmarshal([]byte(valueJSON), &reference)
+	if err != nil {
+		t.Fatalf("encoding/json decoding %s: %s", valueJSON, err)
+	}
+	if actual != reference {
+		t.Errorf("decoding %s: encoding/json produced %q, but got %q", valueJSON, reference, actual)
+	}
+}
+
+func TestDecodeSurrogatePair(t *testing.T) {
+	testDecodeString(t, `"\uD83D\uDE00"`, "\xf0\x9f\x98\x80")
+	testDecodeString(t, `"smile \ud83d\ude00!"`, "smile \U0001F600!")
+}
+
+func TestDecodeUnpairedSurrogate(t *testing.T) {
+	testDecodeString(t, `"\uD83D x"`, "\ufffd x")
+	testDecodeString(t, `"\uD83D"`, "\ufffd")
+	testDecodeString(t, `"\uDE00\uD83D"`, "\ufffd\ufffd")
+	testDecodeString(t, `"\uD83DA"`, "\ufffdA")
+}
+
+func TestDecodeEscapes(t *testing.T) {
+	testDecodeString(t, `"caf\u00e9"`, "caf\u00e9")
+	testDecodeString(t, `"\\uD83D"`, `\uD83D`)
+	testDecodeString(t, `"a\"b\\c\/d\n\t\r\b\f"`, "a\"b\\c/d\n\t\r\b\f")
+	testDecodeString(t, `"plain"`, "plain")
+	testDecodeString(t, `"😀"`, "\U0001F600")
+}
@@ -1,181 +1,447 @@
 package tinynote
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"sort"
 	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/valyala/fastjson"
 )
 
+// RawJSON is a JSON fragment that is emitted verbatim as a value, rather than being encoded
+// as a string.  It must be valid JSON.
+type RawJSON string
+
+// NoteGoCompatibleJSON causes ObjectToJSON to produce the same bytes as note-go (which uses
+// encoding/json) for the same object, which is useful when sharing test fixtures between the
+// libraries: keys are sorted, strings are escaped as encoding/json does (including its escaping
+// of HTML characters), very large and very small floats are formatted with exponents, large
+// uint64 values are preserved, and byte slices are encoded as base64 strings.  These
+// differences from encoding/json remain:
+//
+//   - nil maps and slices are encoded as {} and [] rather than null
+//   - NaN and infinities are encoded rather than causing an error
+//   - an error is encoded as its message rather than as the fields of its concrete type
+//   - a RawJSON value is emitted verbatim rather than as a string
+//   - values of types that this encoder doesn't support cause an error rather than being
+//     encoded by reflection
+var NoteGoCompatibleJSON = false
+
+// Formatting variations applied while encoding
+type jsonFormat struct {
+	sorted bool
+	noteGo bool
+}
+
 // ObjectToJSON converts an object to JSON
 func ObjectToJSON(object map[string]interface{}) (objectJSON []byte, err error) {
-	var objectJSONstr string
-	objectJSONstr, err = walkMap(0, object)
-	objectJSON = []byte(objectJSONstr)
+	var buf bytes.Buffer
+	format := jsonFormat{sorted: NoteGoCompatibleJSON, noteGo: NoteGoCompatibleJSON}
+	err = walkMap(0, object, format, &jsonWriter{w: &buf})
+	if err != nil {
+		return
+	}
+	objectJSON = buf.Bytes()
 	return
 }
 
+// ObjectToJSONStream converts an object to JSON just as ObjectToJSON does, writing it to w as
+// it is generated rather than accumulating it in memory.  Output is gathered into writes of up
+// to jsonStreamChunk bytes, so that a writer such as a UART isn't given a write per token.  If
+// the object can't be encoded, the error is returned without writing what remains buffered, so
+// nothing is written unless the encoding had already exceeded a chunk.
+func ObjectToJSONStream(w io.Writer, object map[string]interface{}) (err error) {
+	format := jsonFormat{sorted: NoteGoCompatibleJSON, noteGo: NoteGoCompatibleJSON}
+	chunked := bufio.NewWriterSize(w, jsonStreamChunk)
+	err = walkMap(0, object, format, &jsonWriter{w: chunked})
+	if err != nil {
+		return
+	}
+	return chunked.Flush()
+}
+
+// ObjectToCanonicalJSON converts an object to JSON with keys sorted at every level, so that
+// the same object always produces the same bytes, such as when comparing requests or computing
+// a digest of one, because ObjectToJSON emits keys in Go's randomized map order.  Requests
+// protected by EnableCRC don't require this, because the CRC covers the bytes transmitted.
+func ObjectToCanonicalJSON(object map[string]interface{}) (objectJSON []byte, err error) {
+	var buf bytes.Buffer
+	format := jsonFormat{sorted: true, noteGo: NoteGoCompatibleJSON}
+	err = walkMap(0, object, format, &jsonWriter{w: &buf})
+	if err != nil {
+		return
+	}
+	objectJSON = buf.Bytes()
+	return
+}
+
+// The length of the writes in which ObjectToJSONStream emits its output
+const jsonStreamChunk = 256
+
+// A writer that retains the first error, so that encoding needn't check each write
+type jsonWriter struct {
+	w   io.Writer
+	err error
+}
+
+// Write a token
+func (out *jsonWriter) write(s string) {
+	if out.err == nil {
+		_, out.err = io.WriteString(out.w, s)
+	}
+}
+
 // Walk the map, separating fields with an underscore
-func walkMap(level int, object map[string]interface{}) (out string, err error) {
+func walkMap(level int, object map[string]interface{}, format jsonFormat, out *jsonWriter) (err error) {
+
+	// Determine the order in which to emit keys
+	keys := make([]string, 0, len(object))
+	for k := range object {
+		keys = append(keys, k)
+	}
+	if format.sorted {
+		sort.Strings(keys)
+	}
 
 	// Iterate over keys in object
-	out += "{"
+	out.write("{")
 
-	for k, v := range object {
+	for i, k := range keys {
+		v := object[k]
 
 		// Output field
-		if out != "{" {
-			out += ","
-		}
-		out += "\""
-		out += k
-		out += "\":"
-
-		// Only add the key if it's a basic data type
-		value := "\"\""
-		switch v.(type) {
-		case nil:
-			value = "null"
-		case bool:
-			value = strconv.FormatBool(v.(bool))
-		case int:
-			value = strconv.FormatInt(int64(v.(int)), 10)
-		case uint:
-			value = strconv.FormatInt(int64(v.(uint)), 10)
-		case int32:
-			value = strconv.FormatInt(int64(v.(int32)), 10)
-		case uint32:
-			value = strconv.FormatInt(int64(v.(uint32)), 10)
-		case int64:
-			value = strconv.FormatInt(int64(v.(int64)), 10)
-		case uint64:
-			value = strconv.FormatInt(int64(v.(uint64)), 10)
-		case float32:
-			value = strconv.FormatFloat(float64(v.(float32)), 'f', -1, 32)
-		case float64:
-			value = strconv.FormatFloat(v.(float64), 'f', -1, 64)
-		case string:
-			value = strconv.Quote(v.(string))
-		case map[string]interface{}:
-			value, err = walkMap(level+1, v.(map[string]interface{}))
+		if i != 0 {
+			out.write(",")
+		}
+		out.write(format.key(k))
+		out.write(":")
+		err = walkValue(level, k, v, format, out)
+		if err != nil {
+			return
+		}
+	}
+
+	// Done
+	out.write("}")
+	err = out.err
+	return
+
+}
+
+// Encode a value of any of the supported types, which include every type that JSONToObject
+// produces, naming the key under which it appears in any error
+func walkValue(level int, k string, v interface{}, format jsonFormat, out *jsonWriter) (err error) {
+
+	switch v.(type) {
+	case nil:
+		out.write("null")
+	case bool:
+		out.write(strconv.FormatBool(v.(bool)))
+	case int:
+		out.write(strconv.FormatInt(int64(v.(int)), 10))
+	case uint:
+		out.write(strconv.FormatInt(int64(v.(uint)), 10))
+	case int8:
+		out.write(strconv.FormatInt(int64(v.(int8)), 10))
+	case uint8:
+		out.write(strconv.FormatInt(int64(v.(uint8)), 10))
+	case int16:
+		out.write(strconv.FormatInt(int64(v.(int16)), 10))
+	case uint16:
+		out.write(strconv.FormatInt(int64(v.(uint16)), 10))
+	case int32:
+		out.write(strconv.FormatInt(int64(v.(int32)), 10))
+	case uint32:
+		out.write(strconv.FormatInt(int64(v.(uint32)), 10))
+	case int64:
+		out.write(strconv.FormatInt(int64(v.(int64)), 10))
+	case uint64:
+		out.write(format.uint(v.(uint64)))
+	case float32:
+		out.write(format.float(float64(v.(float32)), 32))
+	case float64:
+		out.write(format.float(v.(float64), 64))
+	case string:
+		out.write(format.quote(v.(string)))
+	case RawJSON:
+		err = fastjson.Validate(string(v.(RawJSON)))
+		if err != nil {
+			err = fmt.Errorf("invalid raw JSON for %s: %s", k, err)
+			return
+		}
+		out.write(string(v.(RawJSON)))
+	case map[string]interface{}:
+		err = walkMap(level+1, v.(map[string]interface{}), format, out)
+		if err != nil {
+			return
+		}
+	case []int:
+		out.write("[")
+		for i := 0; i < len(v.([]int)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(int64(v.([]int)[i]), 10))
+		}
+		out.write("]")
+	case []uint:
+		out.write("[")
+		for i := 0; i < len(v.([]uint)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(int64(v.([]uint)[i]), 10))
+		}
+		out.write("]")
+	case []int8:
+		out.write("[")
+		for i := 0; i < len(v.([]int8)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(int64(v.([]int8)[i]), 10))
+		}
+		out.write("]")
+	case []uint8:
+		// encoding/json treats a byte slice as binary data
+		if format.noteGo {
+			out.write(format.quote(base64.StdEncoding.EncodeToString(v.([]uint8))))
+			break
+		}
+		out.write("[")
+		for i := 0; i < len(v.([]uint8)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(int64(v.([]uint8)[i]), 10))
+		}
+		out.write("]")
+	case []int16:
+		out.write("[")
+		for i := 0; i < len(v.([]int16)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(int64(v.([]int16)[i]), 10))
+		}
+		out.write("]")
+	case []uint16:
+		out.write("[")
+		for i := 0; i < len(v.([]uint16)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(int64(v.([]uint16)[i]), 10))
+		}
+		out.write("]")
+	case []int32:
+		out.write("[")
+		for i := 0; i < len(v.([]int32)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(int64(v.([]int32)[i]), 10))
+		}
+		out.write("]")
+	case []uint32:
+		out.write("[")
+		for i := 0; i < len(v.([]uint32)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(int64(v.([]uint32)[i]), 10))
+		}
+		out.write("]")
+	case []int64:
+		out.write("[")
+		for i := 0; i < len(v.([]int64)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatInt(v.([]int64)[i], 10))
+		}
+		out.write("]")
+	case []uint64:
+		out.write("[")
+		for i := 0; i < len(v.([]uint64)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(format.uint(v.([]uint64)[i]))
+		}
+		out.write("]")
+	case []float32:
+		out.write("[")
+		for i := 0; i < len(v.([]float32)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(format.float(float64(v.([]float32)[i]), 32))
+		}
+		out.write("]")
+	case []float64:
+		out.write("[")
+		for i := 0; i < len(v.([]float64)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(format.float(v.([]float64)[i], 64))
+		}
+		out.write("]")
+	case []string:
+		out.write("[")
+		for i := 0; i < len(v.([]string)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(format.quote(v.([]string)[i]))
+		}
+		out.write("]")
+	case []map[string]interface{}:
+		out.write("[")
+		for i := 0; i < len(v.([]map[string]interface{})); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			err = walkMap(level+1, v.([]map[string]interface{})[i], format, out)
 			if err != nil {
 				return
 			}
-		case []int:
-			value = "["
-			for i := 0; i < len(v.([]int)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.FormatInt(int64(v.([]int)[i]), 10)
-			}
-			value += "]"
-		case []uint:
-			value = "["
-			for i := 0; i < len(v.([]uint)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.FormatInt(int64(v.([]uint)[i]), 10)
-			}
-			value += "]"
-		case []int32:
-			value = "["
-			for i := 0; i < len(v.([]int32)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.FormatInt(int64(v.([]int32)[i]), 10)
-			}
-			value += "]"
-		case []uint32:
-			value = "["
-			for i := 0; i < len(v.([]uint32)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.FormatInt(int64(v.([]uint32)[i]), 10)
-			}
-			value += "]"
-		case []int64:
-			value = "["
-			for i := 0; i < len(v.([]int64)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.FormatInt(v.([]int64)[i], 10)
-			}
-			value += "]"
-		case []uint64:
-			value = "["
-			for i := 0; i < len(v.([]uint64)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.FormatInt(int64(v.([]uint64)[i]), 10)
-			}
-			value += "]"
-		case []float32:
-			value = "["
-			for i := 0; i < len(v.([]float32)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.FormatFloat(float64(v.([]float32)[i]), 'f', -1, 32)
-			}
-			value += "]"
-		case []float64:
-			value = "["
-			for i := 0; i < len(v.([]float64)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.FormatFloat(v.([]float64)[i], 'f', -1, 64)
-			}
-			value += "]"
-		case []string:
-			value = "["
-			for i := 0; i < len(v.([]string)); i++ {
-				if i != 0 {
-					value += ","
-				}
-				value += strconv.Quote(v.([]string)[i])
-			}
-			value += "]"
-		case []map[string]interface{}:
-			value = "["
-			for i := 0; i < len(v.([]map[string]interface{})); i++ {
-				if i != 0 {
-					value += ","
-				}
-				var ovalue string
-				ovalue, err = walkMap(level+1, v.([]map[string]interface{})[i])
-				if err != nil {
-					return
-				}
-				value += ovalue
-			}
-			value += "]"
-		case []interface{}:
-			value = "["
-			for i := 0; i < len(v.([]interface{})); i++ {
-				if i != 0 {
-					value += ","
-				}
-				var ovalue string
-				ovalue, err = walkMap(level+1, v.([]interface{})[i].(map[string]interface{}))
-				if err != nil {
-					return
-				}
-				value += ovalue
-			}
-			value += "]"
-		}
-
-		// Append the value
-		out += value
-
+		}
+		out.write("]")
+	case []bool:
+		out.write("[")
+		for i := 0; i < len(v.([]bool)); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			out.write(strconv.FormatBool(v.([]bool)[i]))
+		}
+		out.write("]")
+	case []interface{}:
+		// Elements may be of differing types, including nil and nested arrays
+		out.write("[")
+		for i := 0; i < len(v.([]interface{})); i++ {
+			if i != 0 {
+				out.write(",")
+			}
+			err = walkValue(level+1, k, v.([]interface{})[i], format, out)
+			if err != nil {
+				return
+			}
+		}
+		out.write("]")
+	case time.Duration:
+		// Durations are encoded as seconds, the unit used throughout the Notecard API,
+		// including any fractional part, except when matching encoding/json, which encodes
+		// them as an integer count of nanoseconds
+		if format.noteGo {
+			out.write(strconv.FormatInt(int64(v.(time.Duration)), 10))
+		} else {
+			out.write(format.float(v.(time.Duration).Seconds(), 64))
+		}
+	case error:
+		// Errors are a common way of reporting diagnostics, so encode their message
+		out.write(format.quote(v.(error).Error()))
+	default:
+		err = fmt.Errorf("cannot encode %s: unsupported type %T", k, v)
+		return
 	}
 
 	// Done
-	out += "}"
 	return
 
 }
+
+// Format a key
+func (format jsonFormat) key(k string) string {
+	if format.noteGo {
+		return format.quote(k)
+	}
+	return "\"" + k + "\""
+}
+
+// Format a uint64
+func (format jsonFormat) uint(u uint64) string {
+	if format.noteGo {
+		return strconv.FormatUint(u, 10)
+	}
+	return strconv.FormatInt(int64(u), 10)
+}
+
+// Format a float of the specified bit size
+func (format jsonFormat) float(f float64, bits int) string {
+	if !format.noteGo {
+		return strconv.FormatFloat(f, 'f', -1, bits)
+	}
+
+	// As with encoding/json, use an exponent for very large and very small magnitudes,
+	// and trim the exponent's leading zero
+	fmtByte := byte('f')
+	abs := math.Abs(f)
+	if abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			fmtByte = 'e'
+		}
+	}
+	b := strconv.AppendFloat(nil, f, fmtByte, -1, bits)
+	if fmtByte == 'e' {
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return string(b)
+}
+
+// Quote a string, escaping only what JSON requires unless matching encoding/json, which also
+// escapes HTML characters and the line and paragraph separators
+func (format jsonFormat) quote(s string) string {
+	const hex = "0123456789abcdef"
+	out := []byte{'"'}
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				out = append(out, '\\', c)
+			case c == '\n':
+				out = append(out, '\\', 'n')
+			case c == '\r':
+				out = append(out, '\\', 'r')
+			case c == '\t':
+				out = append(out, '\\', 't')
+			case c == '\b':
+				out = append(out, '\\', 'b')
+			case c == '\f':
+				out = append(out, '\\', 'f')
+			case c < 0x20 || (format.noteGo && (c == '<' || c == '>' || c == '&')):
+				out = append(out, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			default:
+				out = append(out, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			out = append(out, "\ufffd"...)
+		case format.noteGo && (r == '\u2028' || r == '\u2029'):
+			out = append(out, '\\', 'u', '2', '0', '2', hex[r&0xF])
+		default:
+			out = append(out, s[i:i+size]...)
+		}
+		i += size
+	}
+	out = append(out, '"')
+	return string(out)
+}
@@ -0,0 +1,219 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Decode JSON and encode the result, verifying that the same JSON is produced
+func testRoundTrip(t *testing.T, objectJSON string) {
+	t.Helper()
+	object, err := JSONToObject([]byte(objectJSON))
+	if err != nil {
+		t.Fatalf("decoding %s: %s", objectJSON, err)
+	}
+	encoded, err := ObjectToCanonicalJSON(object)
+	if err != nil {
+		t.Fatalf("encoding %s: %s", objectJSON, err)
+	}
+	if string(encoded) != objectJSON {
+		t.Errorf("round trip of %s produced %s", objectJSON, encoded)
+	}
+}
+
+func TestRoundTripNestedArrays(t *testing.T) {
+	testRoundTrip(t, `{"a":[[1,2],[3]]}`)
+	testRoundTrip(t, `{"a":[[[1.5],["x"]],[]]}`)
+}
+
+func TestRoundTripArrayOfArraysOfObjects(t *testing.T) {
+	testRoundTrip(t, `{"a":[[{"a":1}]]}`)
+	testRoundTrip(t, `{"a":[[{"a":1}],[{"b":2}]]}`)
+}
+
+func TestRoundTripArrayContainingNull(t *testing.T) {
+	tests := []struct {
+		arrayJSON string
+		nulls     []int
+	}{
+		{`[null,1,2]`, []int{0}},
+		{`[1,null]`, []int{1}},
+		{`[null]`, []int{0}},
+		{`[null,"x",{"b":1}]`, []int{0}},
+		{`[[1,null],null,[true]]`, []int{1}},
+	}
+	for _, test := range tests {
+		objectJSON := `{"a":` + test.arrayJSON + `}`
+		testRoundTrip(t, objectJSON)
+		object, err := JSONToObject([]byte(objectJSON))
+		if err != nil {
+			t.Fatalf("decoding %s: %s", test.arrayJSON, err)
+		}
+		array, isArray := object["a"].([]interface{})
+		if !isArray {
+			t.Errorf("decoding %s: expected []interface{}, got %T", test.arrayJSON, object["a"])
+			continue
+		}
+		for _, i := range test.nulls {
+			if array[i] != nil {
+				t.Errorf("decoding %s: expected element %d to be nil, got %#v", test.arrayJSON, i, array[i])
+			}
+		}
+	}
+}
+
+func TestRoundTripBooleanArray(t *testing.T) {
+	testRoundTrip(t, `{"a":[true,false]}`)
+}
+
+func TestEncodeMixedInterfaceArray(t *testing.T) {
+	object := map[string]interface{}{
+		"a": []interface{}{nil, true, 1, "x", []interface{}{2.5}, map[string]interface{}{"b": 1}},
+	}
+	encoded, err := ObjectToJSON(object)
+	if err != nil {
+		t.Fatalf("encoding: %s", err)
+	}
+	expected := `{"a":[null,true,1,"x",[2.5],{"b":1}]}`
+	if string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestEncodeUnsupportedArrayElement(t *testing.T) {
+	object := map[string]interface{}{
+		"a": []interface{}{1, struct{}{}},
+	}
+	objectJSON, err := ObjectToJSON(object)
+	if err == nil {
+		t.Errorf("expected an error encoding an unsupported array element")
+	}
+	if objectJSON != nil {
+		t.Errorf("a failed encoding should yield nothing, got %s", objectJSON)
+	}
+}
+
+func TestEncodeStreamWritesNothingOnError(t *testing.T) {
+	object := map[string]interface{}{"bad": struct{}{}}
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		object[k] = k
+	}
+	var buf bytes.Buffer
+	err := ObjectToJSONStream(&buf, object)
+	if err == nil {
+		t.Errorf("expected an error encoding an unsupported value")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("a failed encoding should write nothing, wrote %s", buf.Bytes())
+	}
+	buf.Reset()
+	delete(object, "bad")
+	err = ObjectToJSONStream(&buf, object)
+	if err != nil {
+		t.Fatalf("encoding: %s", err)
+	}
+	testDecodeMatches(t, buf.Bytes(), object)
+}
+
+// A writer that records the length of each write
+type testWriteRecorder struct {
+	bytes.Buffer
+	writes []int
+}
+
+// Record a write
+func (w *testWriteRecorder) Write(p []byte) (n int, err error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestEncodeStreamWritesChunks(t *testing.T) {
+	object := map[string]interface{}{}
+	for i := 0; i < 100; i++ {
+		object[fmt.Sprintf("field%d", i)] = []interface{}{i, "value", true, nil}
+	}
+	w := &testWriteRecorder{}
+	err := ObjectToJSONStream(w, object)
+	if err != nil {
+		t.Fatalf("encoding: %s", err)
+	}
+	expected, err := ObjectToJSON(object)
+	if err != nil {
+		t.Fatalf("encoding: %s", err)
+	}
+	if w.Len() != len(expected) {
+		t.Errorf("expected %d bytes, got %d", len(expected), w.Len())
+	}
+	if len(w.writes) > (len(expected)+jsonStreamChunk-1)/jsonStreamChunk {
+		t.Errorf("%d bytes should take no more than %d-byte writes, took %v", len(expected), jsonStreamChunk, w.writes)
+	}
+	decoded, err := JSONToObject(w.Bytes())
+	if err != nil || len(decoded) != len(object) {
+		t.Errorf("the output doesn't decode to the object: %v", err)
+	}
+}
+
+// Encode an object in note-go compatible mode
+func noteGoJSON(object map[string]interface{}) (objectJSON []byte, err error) {
+	wasCompatible := NoteGoCompatibleJSON
+	NoteGoCompatibleJSON = true
+	objectJSON, err = ObjectToJSON(object)
+	NoteGoCompatibleJSON = wasCompatible
+	return
+}
+
+func TestNoteGoCompatibleMatchesEncodingJSON(t *testing.T) {
+	object := map[string]interface{}{
+		"req":   "note.add",
+		"html":  "<a href=\"x\">&</a> ",
+		"big":   1e21,
+		"small": 1e-7,
+		"f32":   float32(0.1),
+		"u64":   uint64(18446744073709551615),
+		"i16":   int16(-3),
+		"dur":   2 * time.Second,
+		"bytes": []byte{1, 2, 3},
+		"list":  []interface{}{nil, true, "x", []byte{4}},
+		"body":  map[string]interface{}{"z": 1, "a": []int{1, 2}},
+	}
+	expected, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("encoding/json: %s", err)
+	}
+	actual, err := noteGoJSON(object)
+	if err != nil {
+		t.Fatalf("encoding: %s", err)
+	}
+	if string(actual) != string(expected) {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestEncodeDurationInSeconds(t *testing.T) {
+	objectJSON, err := ObjectToJSON(map[string]interface{}{"seconds": 1500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("encoding: %s", err)
+	}
+	if string(objectJSON) != "{\"seconds\":1.5}" {
+		t.Errorf("expected {\"seconds\":1.5}, got %s", objectJSON)
+	}
+}
+
+// Verify that JSON decodes to the expected object
+func testDecodeMatches(t *testing.T, objectJSON []byte, expected map[string]interface{}) {
+	decoded, err := JSONToObject(objectJSON)
+	if err != nil {
+		t.Fatalf("%s doesn't decode: %s", objectJSON, err)
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("%s decodes to %v rather than %v", objectJSON, decoded, expected)
+	}
+}
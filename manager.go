@@ -0,0 +1,83 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"sort"
+	"sync"
+)
+
+// Manager tracks several open Notecards by name, such as on a gateway with cards on different
+// busses or addresses.  The zero value is an empty Manager ready for use.
+type Manager struct {
+	lock     sync.Mutex
+	contexts map[string]*Context
+}
+
+// Add adds a context to the manager under the specified name, replacing any context
+// previously added under that name without closing it
+func (manager *Manager) Add(name string, context *Context) {
+	manager.lock.Lock()
+	if manager.contexts == nil {
+		manager.contexts = map[string]*Context{}
+	}
+	manager.contexts[name] = context
+	manager.lock.Unlock()
+}
+
+// Get returns the context added under the specified name, or nil if there is none
+func (manager *Manager) Get(name string) (context *Context) {
+	manager.lock.Lock()
+	context = manager.contexts[name]
+	manager.lock.Unlock()
+	return
+}
+
+// Names returns the names of the contexts in the manager, in sorted order
+func (manager *Manager) Names() (names []string) {
+	manager.lock.Lock()
+	names = make([]string, 0, len(manager.contexts))
+	for name := range manager.contexts {
+		names = append(names, name)
+	}
+	manager.lock.Unlock()
+	sort.Strings(names)
+	return
+}
+
+// CloseAll closes and removes all of the contexts in the manager
+func (manager *Manager) CloseAll() {
+	manager.lock.Lock()
+	contexts := manager.contexts
+	manager.contexts = nil
+	manager.lock.Unlock()
+	for _, context := range contexts {
+		context.Close()
+	}
+}
+
+// Broadcast performs the same request on each of the cards in the manager, in order of
+// name, returning the response or error from each indexed by name
+func (manager *Manager) Broadcast(req map[string]interface{}) (rsps map[string]map[string]interface{}, errs map[string]error) {
+
+	rsps = map[string]map[string]interface{}{}
+	errs = map[string]error{}
+	for _, name := range manager.Names() {
+		context := manager.Get(name)
+		if context == nil {
+			continue
+		}
+		rsp, err := context.Transaction(req)
+		if err != nil {
+			errs[name] = err
+		} else {
+			rsps[name] = rsp
+		}
+	}
+
+	// Done
+	return
+
+}
@@ -0,0 +1,538 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// EncodePayload encodes data as base64 for a payload field, using the specified encoding, or
+// base64.StdEncoding (as used by the Notecard for payloads) if nil.  Other encodings, such as
+// base64.URLEncoding, may be needed for content that is forwarded to or from other services.
+func EncodePayload(data []byte, encoding *base64.Encoding) string {
+	if encoding == nil {
+		encoding = base64.StdEncoding
+	}
+	return encoding.EncodeToString(data)
+}
+
+// DecodePayload decodes a base64 payload field, using the specified encoding, or
+// base64.StdEncoding if nil
+func DecodePayload(payload string, encoding *base64.Encoding) (data []byte, err error) {
+	if encoding == nil {
+		encoding = base64.StdEncoding
+	}
+	return encoding.DecodeString(payload)
+}
+
+// AddNoteOptions modifies the behavior of AddNote
+type AddNoteOptions struct {
+
+	// Sync to the notehub immediately after this note is added
+	Sync bool
+
+	// When non-zero, the card automatically syncs once the notefile has accumulated this
+	// many notes, rather than waiting for its periodic outbound sync.  Unlike Sync, this
+	// lets bursts of notes be batched into a single session.
+	Max int
+
+	// When set along with Max, the card rejects notes added beyond Max rather than
+	// accepting them and syncing
+	Limit bool
+}
+
+// AddNoteResult holds the details reported by the card in response to note.add, any of which
+// are left zero when not reported
+type AddNoteResult struct {
+
+	// True if the note was stored in the compact form defined by the notefile's template
+	Template bool
+
+	// The number of notes now pending in the notefile
+	Total int
+}
+
+// AddNote adds a note with the specified body and optional payload to a notefile
+func (context *Context) AddNote(file string, body map[string]interface{}, payload []byte, opts AddNoteOptions) (err error) {
+	_, err = context.AddNoteDetails(file, body, payload, opts)
+	return
+}
+
+// AddNoteDetails adds a note just as AddNote does, additionally returning the card's report
+// of how it was stored, which may be used to confirm that a template is being applied
+func (context *Context) AddNoteDetails(file string, body map[string]interface{}, payload []byte, opts AddNoteOptions) (result AddNoteResult, err error) {
+	return context.addNote(file, body, payload, false, opts)
+}
+
+// AddNoteBinary adds a note just as AddNote does, but rather than being encoded within the
+// request, the payload is staged in the card's binary store and referenced by the note, which
+// reduces both the data transferred and the RAM required.  If the card's firmware doesn't
+// support the binary store, the payload is encoded within the request as with AddNote.
+func (context *Context) AddNoteBinary(file string, body map[string]interface{}, payload []byte, opts AddNoteOptions) (err error) {
+
+	// Fall back to an inline payload if there is no binary store
+	if len(payload) == 0 {
+		return context.AddNote(file, body, nil, opts)
+	}
+	_, cardErr, err := context.TransactionResult(NewRequest("card.binary"))
+	if err != nil {
+		return
+	}
+	if cardErr != nil {
+		return context.AddNote(file, body, payload, opts)
+	}
+
+	// Stage the payload and add the note that references it
+	err = context.BinaryReset()
+	if err != nil {
+		return
+	}
+	err = context.BinaryTransmit(payload, BinaryOptions{})
+	if err != nil {
+		return
+	}
+	_, err = context.addNote(file, body, nil, true, opts)
+
+	// Done
+	return
+
+}
+
+// Add a note, with its payload either supplied or staged in the binary store
+func (context *Context) addNote(file string, body map[string]interface{}, payload []byte, binary bool, opts AddNoteOptions) (result AddNoteResult, err error) {
+
+	// Validate the options
+	if opts.Max < 0 {
+		err = fmt.Errorf("note.add: max must not be negative (%d)", opts.Max)
+		return
+	}
+	if opts.Limit && opts.Max == 0 {
+		err = fmt.Errorf("note.add: limit requires max to be specified")
+		return
+	}
+
+	// Build and perform the request
+	req := NewRequest("note.add")
+	if file != "" {
+		req["file"] = file
+	}
+	if context.SeqField != "" {
+		var seq int64
+		seq, err = context.NextSeq()
+		if err != nil {
+			return
+		}
+		bodyWithSeq := map[string]interface{}{}
+		for k, v := range body {
+			bodyWithSeq[k] = v
+		}
+		bodyWithSeq[context.SeqField] = seq
+		body = bodyWithSeq
+	}
+	if body != nil {
+		req["body"] = body
+	}
+	if len(payload) > 0 {
+		req["payload"] = EncodePayload(payload, nil)
+	}
+	if binary {
+		req["binary"] = true
+	}
+	if opts.Sync {
+		req["sync"] = true
+	}
+	if opts.Max > 0 {
+		req["max"] = opts.Max
+	}
+	if opts.Limit {
+		req["limit"] = true
+	}
+	rsp, err := context.Transaction(req)
+	if err != nil {
+		return
+	}
+	result.Template = boolField(rsp, "template")
+	result.Total = intField(rsp, "total")
+
+	// Done
+	return
+
+}
+
+// NextSeq returns the next number in a sequence that increments by one with each call, persisted
+// with SeqLoadFn and SeqStoreFn so that it continues across restarts.  The number is recorded
+// before it is returned, so that a number is never issued twice, and if it can't be recorded
+// an error is returned and the sequence doesn't advance.
+func (context *Context) NextSeq() (seq int64, err error) {
+
+	context.seqLock.Lock()
+	defer context.seqLock.Unlock()
+
+	// Load the last number issued before the first is issued
+	if !context.seqLoaded && context.SeqLoadFn != nil {
+		context.seq, err = context.SeqLoadFn()
+		if err != nil {
+			err = fmt.Errorf("sequence: error loading: %s", err)
+			return
+		}
+	}
+	context.seqLoaded = true
+
+	// Record the next number before issuing it
+	seq = context.seq + 1
+	if context.SeqStoreFn != nil {
+		err = context.SeqStoreFn(seq)
+		if err != nil {
+			err = fmt.Errorf("sequence: error storing: %s", err)
+			seq = 0
+			return
+		}
+	}
+	context.seq = seq
+
+	// Done
+	return
+
+}
+
+// GetTemplate returns the template defined for a notefile with note.template, along with the
+// length of the payload that it permits.  If the notefile has no template, template is nil
+// and no error is returned.
+func (context *Context) GetTemplate(file string) (template map[string]interface{}, length int, err error) {
+
+	req := NewRequest("note.template")
+	req["file"] = file
+	rsp, err := context.Transaction(req)
+	if errorHasCode(err, ErrNoteNoExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	template, _ = rsp["body"].(map[string]interface{})
+	length = intField(rsp, "length")
+
+	// Done
+	return
+
+}
+
+// DrainInbound retrieves notes from an inbound notefile, passing each to fn, until the notefile
+// is empty or maxNotes have been processed.  A maxNotes of 0 means no limit.  Each note is
+// deleted only after fn has returned without error, so a note that fn fails to process remains
+// in the notefile to be retrieved again.  When the limit is reached, remaining is the number of
+// notes still waiting in the notefile, so that a low-power application can decide whether to
+// stay awake.
+func (context *Context) DrainInbound(file string, maxNotes int, fn func(body map[string]interface{}, payload []byte) error) (processed int, remaining int, err error) {
+
+	for maxNotes <= 0 || processed < maxNotes {
+
+		// Get the next note, stopping when there are no more
+		req := NewRequest("note.get")
+		req["file"] = file
+		var rsp map[string]interface{}
+		rsp, err = context.Transaction(req)
+		if errorHasCode(err, ErrNoteNoExist) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		// Deliver it
+		var note NoteResult
+		note, err = noteResult(rsp)
+		if err != nil {
+			return
+		}
+		err = fn(note.Body, note.Payload)
+		if err != nil {
+			return
+		}
+
+		// Now that it has been processed, delete it
+		err = context.deleteNextNote(file)
+		if err != nil {
+			return
+		}
+		processed++
+
+	}
+
+	// Find out how many notes are left behind
+	req := NewRequest("file.changes")
+	req["files"] = []string{file}
+	rsp, err := context.Transaction(req)
+	if err != nil {
+		return
+	}
+	info, _ := rsp["info"].(map[string]interface{})
+	fileInfo, _ := info[file].(map[string]interface{})
+	remaining = intField(fileInfo, "total")
+
+	// Done
+	return
+
+}
+
+// Delete the note at the head of an inbound notefile, which is the note that a note.get without
+// deletion most recently returned, without decoding it again
+func (context *Context) deleteNextNote(file string) (err error) {
+
+	req := NewRequest("note.get")
+	req["file"] = file
+	req["delete"] = true
+	reqJSON, err := ObjectToJSON(req)
+	if err != nil {
+		return
+	}
+	_, _, cardErr, err := context.transactionJSON(req, reqJSON, TransactionOptions{fieldsOnly: []string{}})
+	if err == nil {
+		err = cardErr
+	}
+
+	// Done
+	return
+
+}
+
+// NoteResult is a note retrieved from a notefile
+type NoteResult struct {
+	Body    map[string]interface{}
+	Payload []byte
+}
+
+// GetNotes retrieves up to max notes from an inbound notefile, deleting them if requested.
+// On firmware that returns a batch of notes from a single note.get, one request suffices;
+// otherwise, notes are retrieved one at a time.  Because without deletion a note.get always
+// returns the same note, only one note is retrieved in that case unless the firmware supports
+// batches.  An empty notefile yields no notes and no error.
+func (context *Context) GetNotes(file string, max int, delete bool) (notes []NoteResult, err error) {
+
+	notes = []NoteResult{}
+	if max < 1 {
+		max = 1
+	}
+	for len(notes) < max {
+
+		// Request as many notes as are still wanted
+		req := NewRequest("note.get")
+		req["file"] = file
+		if delete {
+			req["delete"] = true
+		}
+		if max-len(notes) > 1 {
+			req["max"] = max - len(notes)
+		}
+		var rsp map[string]interface{}
+		rsp, err = context.Transaction(req)
+		if errorHasCode(err, ErrNoteNoExist) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		// A batch is complete in itself
+		batch, isBatch := rsp["notes"].([]map[string]interface{})
+		if isBatch {
+			for _, note := range batch {
+				var result NoteResult
+				result, err = noteResult(note)
+				if err != nil {
+					return
+				}
+				notes = append(notes, result)
+			}
+			return
+		}
+
+		// Otherwise, this is a single note
+		var result NoteResult
+		result, err = noteResult(rsp)
+		if err != nil {
+			return
+		}
+		notes = append(notes, result)
+		if !delete {
+			return
+		}
+
+	}
+
+	// Done
+	return
+
+}
+
+// GetNotePayload retrieves the next note from an inbound notefile, deleting it if requested, and
+// returns only its payload.  The note's body is never decoded, which saves the processing and
+// memory that would be required for it.  An empty notefile yields an ErrNoteNoExist error.
+func (context *Context) GetNotePayload(file string, delete bool) (payload []byte, err error) {
+
+	req := NewRequest("note.get")
+	req["file"] = file
+	if delete {
+		req["delete"] = true
+	}
+	reqJSON, err := ObjectToJSON(req)
+	if err != nil {
+		return
+	}
+	_, rsp, cardErr, err := context.transactionJSON(req, reqJSON, TransactionOptions{fieldsOnly: []string{"payload"}})
+	if err == nil {
+		err = cardErr
+	}
+	if err != nil {
+		return
+	}
+	payload, err = DecodePayload(stringField(rsp, "payload"), nil)
+	if err != nil {
+		err = fmt.Errorf("note.get: invalid payload: %s", err)
+		return
+	}
+
+	// Done
+	return
+
+}
+
+// Extract a note from a note.get response
+func noteResult(rsp map[string]interface{}) (result NoteResult, err error) {
+	result.Body, _ = rsp["body"].(map[string]interface{})
+	result.Payload, err = DecodePayload(stringField(rsp, "payload"), nil)
+	if err != nil {
+		err = fmt.Errorf("note.get: invalid payload: %s", err)
+	}
+	return
+}
+
+// WatchNotes starts a goroutine that checks the specified inbound notefile every interval,
+// delivering each note that has arrived to fn and deleting it from the card once fn has
+// returned without error.  If fn returns an error, the note is left in the notefile, and
+// delivery resumes with it at the next interval.  The returned function stops the goroutine,
+// waiting for any delivery in progress to complete.
+func (context *Context) WatchNotes(file string, interval time.Duration, fn func(body map[string]interface{}, payload []byte) error) (stop func()) {
+	return startPoller(func() time.Duration {
+		return interval
+	}, func() {
+		_, _, err := context.DrainInbound(file, 0, fn)
+		if err != nil {
+			context.cardReportError(err)
+		}
+	})
+}
+
+// StartStatsReport starts a goroutine that adds a note summarizing the statistics returned by
+// Stats and ErrorCounts to the specified notefile every interval, so that the health of the
+// device's communication with the Notecard is visible in Notehub.  The statistics are cumulative
+// rather than being cleared by each report.  The returned function stops the goroutine, waiting
+// for any report in progress to complete.
+func (context *Context) StartStatsReport(file string, interval time.Duration) (stop func()) {
+	return startPoller(func() time.Duration {
+		return interval
+	}, func() {
+		stats := context.Stats()
+		body := map[string]interface{}{
+			"transactions": stats.Transactions,
+			"errors":       stats.Errors,
+			"max_ms":       durationMs(stats.MaxTime),
+		}
+		if stats.Transactions > 0 {
+			body["avg_ms"] = durationMs(stats.TotalTime / time.Duration(stats.Transactions))
+		}
+		errorCounts := map[string]interface{}{}
+		for code, count := range context.ErrorCounts() {
+			errorCounts[code] = count
+		}
+		if len(errorCounts) > 0 {
+			body["error_counts"] = errorCounts
+		}
+		err := context.AddNote(file, body, nil, AddNoteOptions{})
+		if err != nil {
+			context.cardReportError(err)
+		}
+	})
+}
+
+// Perform housekeeping after a note has been added
+func (context *Context) noteAdded() {
+
+	// Restart the wait for the device to become idle
+	if context.SyncAfterIdle > 0 {
+		context.idleLock.Lock()
+		if context.idleTimer != nil {
+			context.idleTimer.Stop()
+		}
+		context.idleGeneration++
+		generation := context.idleGeneration
+		context.idleTimer = time.AfterFunc(context.SyncAfterIdle, func() {
+			context.syncAfterIdle(generation)
+		})
+		context.idleLock.Unlock()
+	}
+
+	// Sync if storage is nearly full, checking only as often as requested
+	if context.AutoSyncStorageThreshold > 0 {
+		every := uint32(1)
+		if context.AutoSyncStorageCheckEvery > 1 {
+			every = uint32(context.AutoSyncStorageCheckEvery)
+		}
+		if atomic.AddUint32(&context.notesSinceStorageCheck, 1) >= every {
+			atomic.StoreUint32(&context.notesSinceStorageCheck, 0)
+			context.syncIfStorageFull()
+		}
+	}
+
+}
+
+// Sync after no note has been added for SyncAfterIdle, unless the timer of the specified
+// generation has been superseded by a note added since it fired
+func (context *Context) syncAfterIdle(generation uint32) {
+	context.idleLock.Lock()
+	superseded := generation != context.idleGeneration
+	if !superseded {
+		context.idleTimer = nil
+	}
+	context.idleLock.Unlock()
+	if superseded {
+		return
+	}
+	err := context.Request(NewRequest("hub.sync"))
+	if err != nil {
+		context.cardReportError(err)
+	}
+}
+
+// Perform housekeeping after a note couldn't be added because storage is full
+func (context *Context) storageFull() {
+	if context.AutoSyncStorageThreshold > 0 {
+		err := context.Request(NewRequest("hub.sync"))
+		if err != nil {
+			context.cardReportError(err)
+		}
+	}
+}
+
+// Force a sync if storage utilization has reached AutoSyncStorageThreshold
+func (context *Context) syncIfStorageFull() {
+	used, err := context.StorageUsed()
+	if err != nil {
+		context.cardReportError(err)
+		return
+	}
+	if used >= context.AutoSyncStorageThreshold {
+		err = context.Request(NewRequest("hub.sync"))
+		if err != nil {
+			context.cardReportError(err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetNotePayload(t *testing.T) {
+	data := []byte{0, 1, 2, 0xFF}
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte("{\"body\":{\"temp\":21.5,\"list\":[1,2]},\"payload\":\"" + EncodePayload(data, nil) + "\",\"time\":1700000000}\n"), nil
+	})
+	payload, err := context.GetNotePayload("data.qi", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(payload, data) {
+		t.Errorf("expected %v, got %v", data, payload)
+	}
+}
+
+func TestGetNotePayloadEmpty(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte("{\"err\":\"no notes available in queue {note-noexist}\"}\n"), nil
+	})
+	_, err := context.GetNotePayload("data.qi", false)
+	if !errorHasCode(err, ErrNoteNoExist) {
+		t.Errorf("expected %s, got %v", ErrNoteNoExist, err)
+	}
+}
+
+func TestGetNotePayloadInvalid(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte("{\"payload\":\"not base64!\"}\n"), nil
+	})
+	_, err := context.GetNotePayload("data.qi", false)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestJSONFieldsOnly(t *testing.T) {
+	object, err := jsonFieldsOnly([]byte("{\"id\":7,\"body\":{\"a\":1},\"payload\":\"AAE=\",\"err\":\"x\"}"), []string{"payload"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, present := object["body"]; present {
+		t.Errorf("the body should not have been decoded")
+	}
+	if stringField(object, "payload") != "AAE=" || stringField(object, "err") != "x" || intField(object, "id") != 7 {
+		t.Errorf("unexpected fields %v", object)
+	}
+	_, err = jsonFieldsOnly([]byte("[1,2]"), nil)
+	if err == nil {
+		t.Errorf("an array should not be accepted as an object")
+	}
+}
+
+// Open a context whose card has a simulated inbound queue of notes with the specified bodies
+func newTestQueueContext(queue *[]string) (context *Context) {
+	return newTestContext(func(reqJSON []byte) ([]byte, error) {
+		req, err := JSONToObject(reqJSON)
+		if err != nil {
+			return nil, err
+		}
+		switch stringField(req, "req") {
+		case "note.get":
+			if len(*queue) == 0 {
+				return []byte("{\"err\":\"no notes available in queue {note-noexist}\"}\n"), nil
+			}
+			rspJSON := []byte("{\"body\":{\"n\":\"" + (*queue)[0] + "\"}}\n")
+			if boolField(req, "delete") {
+				*queue = (*queue)[1:]
+			}
+			return rspJSON, nil
+		case "file.changes":
+			return []byte(fmt.Sprintf("{\"info\":{\"data.qi\":{\"total\":%d}}}\n", len(*queue))), nil
+		}
+		return []byte("{\"err\":\"unknown request\"}\n"), nil
+	})
+}
+
+func TestDrainInbound(t *testing.T) {
+	queue := []string{"a", "b", "c"}
+	context := newTestQueueContext(&queue)
+	var delivered []string
+	processed, remaining, err := context.DrainInbound("data.qi", 2, func(body map[string]interface{}, payload []byte) error {
+		delivered = append(delivered, stringField(body, "n"))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if processed != 2 || remaining != 1 || strings.Join(delivered, "") != "ab" {
+		t.Errorf("expected notes a and b with one remaining, got %v with %d processed and %d remaining", delivered, processed, remaining)
+	}
+}
+
+func TestDrainInboundKeepsFailedNote(t *testing.T) {
+	queue := []string{"a", "b", "c"}
+	context := newTestQueueContext(&queue)
+	processed, _, err := context.DrainInbound("data.qi", 0, func(body map[string]interface{}, payload []byte) error {
+		if stringField(body, "n") == "b" {
+			return fmt.Errorf("can't process b")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected the error from fn")
+	}
+	if processed != 1 {
+		t.Errorf("expected one note processed, got %d", processed)
+	}
+	if strings.Join(queue, "") != "bc" {
+		t.Errorf("the note that failed should remain, but the queue holds %v", queue)
+	}
+}
+
+func TestWatchNotesRedeliversFailedNote(t *testing.T) {
+	queue := []string{"a", "b"}
+	context := newTestQueueContext(&queue)
+	deliveries := make(chan string, 10)
+	failed := false
+	stop := context.WatchNotes("data.qi", time.Millisecond, func(body map[string]interface{}, payload []byte) error {
+		n := stringField(body, "n")
+		deliveries <- n
+		if n == "a" && !failed {
+			failed = true
+			return fmt.Errorf("can't process a yet")
+		}
+		return nil
+	})
+	var delivered []string
+	for len(delivered) < 3 {
+		select {
+		case n := <-deliveries:
+			delivered = append(delivered, n)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after delivering %v", delivered)
+		}
+	}
+	stop()
+	if strings.Join(delivered, "") != "aab" {
+		t.Errorf("expected a to be delivered again after failing, got %v", delivered)
+	}
+	if len(queue) != 0 {
+		t.Errorf("every processed note should have been deleted, but the queue holds %v", queue)
+	}
+}
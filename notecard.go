@@ -5,10 +5,14 @@
 package tinynote
 
 import (
+	"bytes"
+	gocontext "context"
 	"fmt"
 	"io"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,15 +25,74 @@ const ErrCardIo = "{io}"
 // ErrTimeout is the card timeout error suffix
 const ErrTimeout = "{timeout}"
 
+// ErrNoteNoExist is the card error suffix when there is no note to be retrieved
+const ErrNoteNoExist = "{note-noexist}"
+
+// ErrTemplateIncompatible is the card error suffix when a note doesn't match its notefile's template
+const ErrTemplateIncompatible = "{template-incompatible}"
+
+// ErrDelayed is the card error suffix when a request has been accepted but will complete later
+const ErrDelayed = "{delayed}"
+
+// ErrStorageFull is the card error suffix when a note can't be stored because the card's storage is full
+const ErrStorageFull = "{storage-full}"
+
+// ErrRateLimited is the card error suffix when Notehub is throttling a device for making too many requests
+const ErrRateLimited = "{rate-limited}"
+
+// ErrDFUInProgress is the card error suffix when a request is refused because the card is updating its firmware
+const ErrDFUInProgress = "{dfu-in-progress}"
+
+// ErrTransactionRate is the error suffix when a transaction is refused because it would exceed RateLimit
+const ErrTransactionRate = "{transaction-rate}"
+
+// RetryPolicy governs how a transport retries a read from the card that fails with a hardware
+// error.  Writes aren't retried, because a partially transmitted request can't safely be
+// resent; the port is instead reset before the next transaction.
+type RetryPolicy struct {
+
+	// The number of times a failed read is retried, or 0 to fail immediately
+	MaxRetries int
+
+	// The delay in milliseconds before each retry
+	BackoffMs int
+
+	// The time since the first failure after which no further retries are made, or 0 for no limit
+	TotalTimeout time.Duration
+}
+
+// DefaultSerialRetryPolicy tolerates flaky serial hardware for a couple of seconds
+var DefaultSerialRetryPolicy = RetryPolicy{MaxRetries: 2, BackoffMs: 1000, TotalTimeout: 2 * time.Second}
+
+// DefaultI2CRetryPolicy retries a failed I2C read promptly, several times
+var DefaultI2CRetryPolicy = RetryPolicy{MaxRetries: 10, BackoffMs: 2}
+
+// The delay between attempts made by TransactionDeadline
+const transactionRetryDelay = 250 * time.Millisecond
+
+// The default range of the interval between attempts to reopen the port
+const reopenBackoffMinDefault = 1 * time.Second
+const reopenBackoffMaxDefault = 1 * time.Minute
+
+// The range of the transaction interval imposed by AutoBackoff
+const rateLimitBackoffInitial = 1 * time.Second
+const rateLimitBackoffMax = 5 * time.Minute
+
 // InitialDebugMode is the debug mode that the context is initialized with
 var InitialDebugMode = false
 
-// Protect against multiple concurrent callers
-var transLock sync.RWMutex
+// Protect against multiple concurrent callers, granting access to priority callers first
+var transLock sync.Mutex
+var transAvailable = sync.NewCond(&transLock)
+var transBusy bool
+var transPriorityWaiters int
 
 // SerialTimeoutMs is the response timeout for Notecard serial communications.
 var SerialTimeoutMs = 10000
 
+// The maximum amount by which a serial response buffer is grown at once
+const serialResponseGrowthMax = 4096
+
 // CardI2CMax controls chunk size that's socially appropriate on the I2C bus.
 // It must be 1-253 bytes as per spec (which allows space for the 2-byte header in a 255-byte read)
 const CardI2CMax = 253
@@ -37,6 +100,10 @@ const CardI2CMax = 253
 // I2CTxFn is the function to write and read from the I2C Port
 type I2CTxFn func(i2cAddress uint16, writebuf []byte, readbuf []byte) (err error)
 
+// I2CRecoverFn is the function that clears a wedged I2C bus, typically by taking control of
+// the SCL pin and toggling it until the device holding SDA low releases it
+type I2CRecoverFn func() (err error)
+
 // UARTReadFn is the function to read from the UART port
 type UARTReadFn func(data []byte) (n int, err error)
 
@@ -59,11 +126,49 @@ const CardRequestI2CSegmentMaxLen = 250
 // CardRequestI2CSegmentDelayMs (golint)
 const CardRequestI2CSegmentDelayMs = 250
 
-// RequestSegmentMaxLen (golint)
-var RequestSegmentMaxLen = -1
-
-// RequestSegmentDelayMs (golint)
-var RequestSegmentDelayMs = -1
+// CardRequestSegmentMinDelayMs is the minimum safe delay between segments.  Shorter delays,
+// including zero, risk overrunning the Notecard's interrupt buffer and are raised to this value.
+const CardRequestSegmentMinDelayMs = 20
+
+// RequestSegmentDefault is the value of RequestSegmentMaxLen or RequestSegmentDelayMs, whether
+// the package variables or the fields of a Context, indicating that it is unset.
+const RequestSegmentDefault = -1
+
+// RequestSegmentMaxLen is the segment length of any context whose own RequestSegmentMaxLen is
+// unset, when not RequestSegmentDefault.
+//
+// Deprecated: set the RequestSegmentMaxLen field of the Context instead.
+var RequestSegmentMaxLen = RequestSegmentDefault
+
+// RequestSegmentDelayMs is the segment delay of any context whose own RequestSegmentDelayMs is
+// unset, when not RequestSegmentDefault.
+//
+// Deprecated: set the RequestSegmentDelayMs field of the Context instead.
+var RequestSegmentDelayMs = RequestSegmentDefault
+
+// Get the segment pacing parameters to be used, which are the context's own when set, else
+// those of the deprecated package variables when set, else the transport's defaults.  A segment
+// length that isn't positive can't be honored, so the transport's default is applied instead.
+func (context *Context) requestSegmentParams(defaultMaxLen int, defaultDelayMs int) (maxLen int, delayMs int) {
+	maxLen = context.RequestSegmentMaxLen
+	if maxLen == RequestSegmentDefault {
+		maxLen = RequestSegmentMaxLen
+	}
+	if maxLen <= 0 {
+		maxLen = defaultMaxLen
+	}
+	delayMs = context.RequestSegmentDelayMs
+	if delayMs == RequestSegmentDefault {
+		delayMs = RequestSegmentDelayMs
+	}
+	if delayMs == RequestSegmentDefault {
+		delayMs = defaultDelayMs
+	}
+	if delayMs < CardRequestSegmentMinDelayMs {
+		delayMs = CardRequestSegmentMinDelayMs
+	}
+	return
+}
 
 // Context for the port that is open
 type Context struct {
@@ -71,34 +176,329 @@ type Context struct {
 	// True to emit trace output
 	Debug bool
 
+	// The destination of trace output, or nil to print it to standard output
+	DebugWriter io.Writer
+
+	// Name by which this connection identifies itself, such as "i2c-sensors", when
+	// distinguishing among several Notecards.  Defaults to the interface type if empty.
+	Name string
+
 	// Disable generation of User Agent object
 	DisableUA bool
 
+	// The maximum length of a response, beyond which the transaction fails, or 0 for no limit
+	MaxResponseBytes int
+
+	// The maximum length of each segment in which a request is transmitted, and the delay in
+	// milliseconds between segments.  Each is initialized to RequestSegmentDefault, in which
+	// case the deprecated package variable of the same name applies if set, or else the
+	// transport's default.
+	RequestSegmentMaxLen  int
+	RequestSegmentDelayMs int
+
+	// How a failed read is retried, initialized to the default for the transport
+	RetryPolicy RetryPolicy
+
+	// Drain the port immediately when a garbled response is received, rather than
+	// deferring the reset until the next transaction
+	DrainOnCorruption bool
+
+	// How long after EnvSetBuffered to automatically flush, or 0 to flush only upon EnvFlush or Close
+	EnvFlushInterval time.Duration
+
+	// For testing, a function called before each transaction's I/O which, by returning an error,
+	// causes the transaction to fail with that error without any I/O being performed.  Errors
+	// carrying only card error keywords, such as "{note-noexist}", don't cause a reset.
+	FaultFn func(reqJSON []byte) (err error)
+
+	// When set, lines of trace output enabled by CardTrace that arrive ahead of a response are
+	// delivered to this function rather than being treated as the response
+	TraceFn func(line string)
+
+	// When non-zero, the card's storage utilization is checked after notes are added, and a
+	// sync is forced when it reaches this percentage so that notes aren't lost when storage
+	// fills.  The check is performed once every AutoSyncStorageCheckEvery notes (default 1).
+	AutoSyncStorageThreshold  int
+	AutoSyncStorageCheckEvery int
+
+	// When non-zero, a sync is performed once no note has been added for this long, so that a
+	// burst of notes is sent in a single session soon after the burst ends
+	SyncAfterIdle time.Duration
+
+	// Persistence for the sequence numbers issued by NextSeq, so that the sequence continues
+	// across restarts of the host.  SeqLoadFn is called to retrieve the last number issued
+	// before the first is issued, and SeqStoreFn is called to record each number before it
+	// is issued.  Either may be nil, in which case the sequence begins at 1 on each start.
+	SeqLoadFn  func() (seq int64, err error)
+	SeqStoreFn func(seq int64) (err error)
+
+	// When non-empty, notes added with AddNote and its variants are stamped with the next
+	// sequence number from NextSeq in this field of their body, so that gaps and reordering
+	// can be detected by the recipient
+	SeqField string
+
+	// Source of request IDs when TransactionOptions.AutoID is specified, which defaults
+	// to a counter that increments with each request
+	RequestIDFn func() uint32
+
+	// The minimum time between the start of one transaction and the next, or 0 for no minimum
+	MinTransactionInterval time.Duration
+
+	// The maximum sustained rate of transactions per second, or 0 for no limit, with bursts of up
+	// to RateLimitBurst (default 1) transactions permitted after a quiet period.  A transaction
+	// exceeding the rate is delayed until it conforms, or if RateLimitError is set, fails
+	// with an ErrTransactionRate error.
+	RateLimit      float64
+	RateLimitBurst int
+	RateLimitError bool
+
+	// When a request is rejected because the device is rate-limited, temporarily increase the
+	// interval between transactions, doubling it while the rejections persist.  The interval
+	// returns to MinTransactionInterval as soon as a transaction succeeds.
+	AutoBackoff bool
+
+	// When set, the port is presumed to have been lost when a reset fails, such as when a USB
+	// serial device is unplugged, and this function is called to reopen it.  Until it succeeds,
+	// attempts are made with an exponentially increasing interval between them, from
+	// ReopenBackoffMin (default 1s) to ReopenBackoffMax (default 1m), and transactions fail
+	// immediately in the meantime.
+	ReopenFn         func(context *Context) (err error)
+	ReopenBackoffMin time.Duration
+	ReopenBackoffMax time.Duration
+
+	// When set, serial requests are paced by polling this function, which returns true when the
+	// card is ready for the next segment (such as by sampling a hardware flow-control line),
+	// rather than by waiting a fixed delay between segments.  The fixed delay remains the
+	// upper bound on the wait, so that a card that never indicates readiness is still served.
+	SerialReadyFn func() bool
+
+	// For protocol-level debugging, a function called with the literal bytes transmitted to
+	// the card (dir "tx") and received from it (dir "rx"), including I2C length headers.
+	// The data must not be retained or modified.
+	RawTapFn func(dir string, data []byte)
+
 	// Class functions
 	CloseFn       func(context *Context)
 	ResetFn       func(context *Context) (err error)
+	FlushFn       func(context *Context) (err error)
 	TransactionFn func(context *Context, noResponse bool, reqJSON []byte) (rspJSON []byte, err error)
 
 	// I/O functions
-	i2cTxFn     I2CTxFn
-	uartReadFn  UARTReadFn
-	uartWriteFn UARTWriteFn
+	i2cTxFn      I2CTxFn
+	i2cRecoverFn I2CRecoverFn
+	uartReadFn   UARTReadFn
+	uartWriteFn  UARTWriteFn
 
 	// Interface
 	interfaceName string
 
+	// I2C chunk length chosen by OptimalPacing, superseding the default when non-zero
+	pacingI2CChunkLen int
+
 	// Whether or not a reset is required
 	resetRequired bool
 
 	// I2C instance state
-	i2cAddress uint16
+	i2cAddress        uint16
+	i2cAddressPending uint16
+	i2cQuietUntil     time.Time
+
+	// Most recently assigned request ID
+	lastRequestID uint32
+
+	// Notes added since storage utilization was last checked
+	notesSinceStorageCheck uint32
+
+	// Hub configuration to be restored when leaving commissioning mode
+	commissioningPrior map[string]interface{}
+
+	// Whether the port must be reopened, and when the next attempt may be made
+	reopenRequired bool
+	reopenBackoff  time.Duration
+	reopenAt       time.Time
+
+	// The caller's buffer into which the current response is to be read, if any
+	rspBuf []byte
+
+	// Whether requests are protected with a CRC, and the sequence number of the last one
+	crcEnabled bool
+	crcSeq     uint16
+
+	// The caller's context by which the current transaction may be canceled, if any
+	transCtx gocontext.Context
+
+	// Transaction pacing state
+	lastTransactionAt time.Time
+	backoffInterval   time.Duration
+	rateTokens        float64
+	rateTokensAt      time.Time
+
+	// Sync pending from SyncAfterIdle
+	idleLock       sync.Mutex
+	idleTimer      *time.Timer
+	idleGeneration uint32
+
+	// The sequence number most recently issued by NextSeq
+	seqLock   sync.Mutex
+	seqLoaded bool
+	seq       int64
+
+	// Errors and transactions counted since they were last cleared
+	errorLock   sync.Mutex
+	errorCounts map[string]int
+	stats       Stats
+
+	// Environment variables buffered by EnvSetBuffered
+	envLock    sync.Mutex
+	envPending map[string]string
+	envTimer   *time.Timer
+}
+
+// TransactionOptions modifies the behavior of TransactionWithOpts
+type TransactionOptions struct {
+
+	// Assign an "id" to the request, which the Notecard echoes in its response, and verify
+	// that the response carries the same ID so as to detect a desynchronized stream
+	AutoID bool
+
+	// Gain access to the card ahead of any non-priority requests that are waiting, such as
+	// for an urgent alert.  Priority requests are served in no particular order among
+	// themselves, and a continuous stream of them will starve non-priority requests.
+	Priority bool
+
+	// Skip the delay that holds back other callers following a card.restart or card.restore,
+	// because the caller will itself wait for the card to become ready
+	noRestartDelay bool
+
+	// Don't perform a pending reset before this request.  This reduces the latency of
+	// non-critical commands, at the risk of the request being lost if the port is out of sync.
+	SkipReset bool
+
+	// If the card refuses the request because it is updating its firmware, wait for up to
+	// this long for the update to complete, retrying the request once it has, rather than
+	// returning the error
+	DFUWait time.Duration
+
+	// A buffer into which the transport reads the response, rather than allocating one
+	rspBuf []byte
+
+	// A context whose cancellation aborts the transaction
+	ctx gocontext.Context
+
+	// The ID assigned to the request, which the response must carry, if checkID is set
+	checkID   bool
+	requestID uint32
+
+	// Validate the response but decode only its "err" and "id" fields and these, if not nil,
+	// because the caller needs nothing else from the response
+	fieldsOnly []string
+}
+
+// Gain exclusive access to the I/O port
+func transBegin(priority bool) {
+	transLock.Lock()
+	if priority {
+		transPriorityWaiters++
+	}
+	for transBusy || (!priority && transPriorityWaiters > 0) {
+		transAvailable.Wait()
+	}
+	if priority {
+		transPriorityWaiters--
+	}
+	transBusy = true
+	transLock.Unlock()
+}
+
+// Relinquish exclusive access to the I/O port
+func transEnd() {
+	transLock.Lock()
+	transBusy = false
+	transAvailable.Broadcast()
+	transLock.Unlock()
 }
 
 // Report a critical card error
 func (context *Context) cardReportError(err error) {
 	if context.Debug {
-		fmt.Printf("*** %s\n", err)
+		context.debugf("*** %s\n", err)
+	}
+}
+
+// The error returned when a context that wasn't created by one of the Open functions is used
+func errNotInitialized() error {
+	return fmt.Errorf("context not initialized")
+}
+
+// Stats summarizes the transactions performed through a context since the statistics were
+// last cleared.  The time of a transaction is that spent communicating with the card, excluding
+// any wait for access to the port, for a reset, or for pacing.
+type Stats struct {
+	Transactions int
+	Errors       int
+	TotalTime    time.Duration
+	MaxTime      time.Duration
+}
+
+// Count a transaction and the time it took, along with its error, if any, by each of the
+// error's keywords, or as "{}" if it has none
+func (context *Context) countTransaction(elapsed time.Duration, err error) {
+	context.errorLock.Lock()
+	context.stats.Transactions++
+	context.stats.TotalTime += elapsed
+	if elapsed > context.stats.MaxTime {
+		context.stats.MaxTime = elapsed
+	}
+	if err != nil {
+		context.stats.Errors++
+		codes := ErrorCodes(err)
+		if len(codes) == 0 {
+			codes = []string{"{}"}
+		}
+		if context.errorCounts == nil {
+			context.errorCounts = map[string]int{}
+		}
+		for _, code := range codes {
+			context.errorCounts[code]++
+		}
+	}
+	context.errorLock.Unlock()
+}
+
+// Stats returns the statistics of the transactions performed since they were last cleared
+func (context *Context) Stats() (stats Stats) {
+	context.errorLock.Lock()
+	stats = context.stats
+	context.errorLock.Unlock()
+	return
+}
+
+// ClearStats resets the statistics returned by Stats
+func (context *Context) ClearStats() {
+	context.errorLock.Lock()
+	context.stats = Stats{}
+	context.errorLock.Unlock()
+}
+
+// ErrorCounts returns the number of failed transactions since the counts were last cleared,
+// indexed by error keyword, such as "{io}", with errors that carry no keyword counted as "{}".
+// An error with several keywords is counted under each.  The Notecard doesn't itself provide
+// an accumulation of errors, so these are the errors observed through this context.
+func (context *Context) ErrorCounts() (counts map[string]int) {
+	counts = map[string]int{}
+	context.errorLock.Lock()
+	for code, count := range context.errorCounts {
+		counts[code] = count
 	}
+	context.errorLock.Unlock()
+	return
+}
+
+// ClearErrorCounts resets the counts returned by ErrorCounts
+func (context *Context) ClearErrorCounts() {
+	context.errorLock.Lock()
+	context.errorCounts = nil
+	context.errorLock.Unlock()
 }
 
 // DebugOutput enables/disables debug output
@@ -108,8 +508,26 @@ func (context *Context) DebugOutput(enabled bool) (wasEnabled bool) {
 	return
 }
 
-// Identify the type of this Notecard connection
+// SetDebugWriter directs trace output to w, such as a ring buffer retaining it for later
+// diagnosis, or to standard output if w is nil
+func (context *Context) SetDebugWriter(w io.Writer) {
+	context.DebugWriter = w
+}
+
+// Emit trace output
+func (context *Context) debugf(format string, args ...interface{}) {
+	if context.DebugWriter == nil {
+		fmt.Printf(format, args...)
+		return
+	}
+	fmt.Fprintf(context.DebugWriter, format, args...)
+}
+
+// Identify the type of this Notecard connection, or its Name if one has been assigned
 func (context *Context) Identify() (name string) {
+	if context.Name != "" {
+		return context.Name
+	}
 	return context.interfaceName
 }
 
@@ -125,14 +543,14 @@ func cardResetSerial(context *Context) (err error) {
 	var length int
 	buf := make([]byte, 2048)
 	for {
-		_, err = context.uartWriteFn([]byte("\n"))
+		_, err = context.uartWrite([]byte("\n"))
 		if err != nil {
 			err = fmt.Errorf("error transmitting to module: %s %s", err, ErrCardIo)
 			context.cardReportError(err)
 			return
 		}
 		time.Sleep(750 * time.Millisecond)
-		length, err = context.uartReadFn(buf)
+		length, err = context.uartRead(buf)
 		if err != nil {
 			err = fmt.Errorf("error reading from module: %s %s", err, ErrCardIo)
 			context.cardReportError(err)
@@ -142,7 +560,7 @@ func cardResetSerial(context *Context) (err error) {
 		nonCRLFFound := false
 		for i := 0; i < length && !nonCRLFFound; i++ {
 			if false {
-				fmt.Printf("chr: 0x%02x '%c'\n", buf[i], buf[i])
+				context.debugf("chr: 0x%02x '%c'\n", buf[i], buf[i])
 			}
 			if buf[i] != '\r' {
 				somethingFound = true
@@ -161,6 +579,35 @@ func cardResetSerial(context *Context) (err error) {
 
 }
 
+// Drain any input pending on serial, without the handshake performed by a reset.  Because
+// reads block until timeout when nothing is available, we stop at the first empty read, and
+// we bound the total time spent in case the card is continuously sending.
+func cardFlushSerial(context *Context) (err error) {
+
+	buf := make([]byte, 2048)
+	flushBegan := time.Now()
+	for time.Since(flushBegan) < time.Duration(SerialTimeoutMs)*time.Millisecond {
+		var length int
+		length, err = context.uartRead(buf)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("error reading from module: %s %s", err, ErrCardIo)
+			context.cardReportError(err)
+			return
+		}
+		if length == 0 {
+			break
+		}
+	}
+
+	// Done
+	return
+
+}
+
 // OpenUART opens the card on the specified uart
 func OpenUART(uartReadFn UARTReadFn, uartWriteFn UARTWriteFn) (context *Context, err error) {
 
@@ -173,9 +620,15 @@ func OpenUART(uartReadFn UARTReadFn, uartWriteFn UARTWriteFn) (context *Context,
 	context.uartReadFn = uartReadFn
 	context.uartWriteFn = uartWriteFn
 
+	// Set up pacing and retries
+	context.RequestSegmentMaxLen = RequestSegmentDefault
+	context.RequestSegmentDelayMs = RequestSegmentDefault
+	context.RetryPolicy = DefaultSerialRetryPolicy
+
 	// Set up class functions
 	context.CloseFn = cardCloseSerial
 	context.ResetFn = cardResetSerial
+	context.FlushFn = cardFlushSerial
 	context.TransactionFn = cardTransactionSerial
 
 	// Done
@@ -188,6 +641,13 @@ func cardResetI2C(context *Context) (err error) {
 
 	// Synchronize by guaranteeing not only that I2C works, but that we drain the remainder of any
 	// pending partial reply from a previously-aborted session.
+	return cardFlushI2C(context)
+
+}
+
+// Drain any input pending on I2C
+func cardFlushI2C(context *Context) (err error) {
+
 	chunklen := 0
 	for {
 
@@ -205,8 +665,8 @@ func cardResetI2C(context *Context) (err error) {
 
 		// For the next iteration, reaad the min of what's available and what we're permitted to read
 		chunklen = available
-		if chunklen > CardI2CMax {
-			chunklen = CardI2CMax
+		if chunklen > context.i2cChunkMax() {
+			chunklen = context.i2cChunkMax()
 		}
 
 	}
@@ -232,9 +692,15 @@ func OpenI2C(addr uint16, i2cTxFn I2CTxFn) (context *Context, err error) {
 	// Set up I/O functions
 	context.i2cTxFn = i2cTxFn
 
+	// Set up pacing and retries
+	context.RequestSegmentMaxLen = RequestSegmentDefault
+	context.RequestSegmentDelayMs = RequestSegmentDefault
+	context.RetryPolicy = DefaultI2CRetryPolicy
+
 	// Set up class functions
 	context.CloseFn = cardCloseI2C
 	context.ResetFn = cardResetI2C
+	context.FlushFn = cardFlushI2C
 	context.TransactionFn = cardTransactionI2C
 
 	// Done
@@ -242,6 +708,85 @@ func OpenI2C(addr uint16, i2cTxFn I2CTxFn) (context *Context, err error) {
 
 }
 
+// OpenI2CWithRecovery opens the card on I2C, supplying a function with which RecoverBus can
+// clear the bus if it becomes wedged
+func OpenI2CWithRecovery(addr uint16, i2cTxFn I2CTxFn, i2cRecoverFn I2CRecoverFn) (context *Context, err error) {
+	context, err = OpenI2C(addr, i2cTxFn)
+	if err != nil {
+		return
+	}
+	context.i2cRecoverFn = i2cRecoverFn
+	return
+}
+
+// OpenI2CRetry opens the card on I2C, retrying with the specified delay until the card answers
+// a Probe or attempts are exhausted.  This accommodates a host that powers up before the card
+// is ready.  The error from the last attempt is returned if all of them fail.
+func OpenI2CRetry(addr uint16, i2cTxFn I2CTxFn, attempts int, delay time.Duration) (context *Context, err error) {
+	return openRetry(attempts, delay, func() (*Context, error) {
+		return OpenI2C(addr, i2cTxFn)
+	})
+}
+
+// OpenUARTRetry opens the card on the specified uart, retrying with the specified delay until the
+// card answers a Probe or attempts are exhausted.  The error from the last attempt is returned
+// if all of them fail.
+func OpenUARTRetry(uartReadFn UARTReadFn, uartWriteFn UARTWriteFn, attempts int, delay time.Duration) (context *Context, err error) {
+	return openRetry(attempts, delay, func() (*Context, error) {
+		return OpenUART(uartReadFn, uartWriteFn)
+	})
+}
+
+// Open and probe the card until it answers
+func openRetry(attempts int, delay time.Duration, openFn func() (*Context, error)) (context *Context, err error) {
+	for i := 0; i < attempts || i == 0; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+		context, err = openFn()
+		if err != nil {
+			continue
+		}
+		err = context.Probe()
+		if err == nil {
+			return
+		}
+		context.Close()
+	}
+	context = nil
+	return
+}
+
+// Deliver raw bytes to RawTapFn, if set
+func (context *Context) tap(dir string, data []byte) {
+	if context.RawTapFn != nil {
+		context.RawTapFn(dir, data)
+	}
+}
+
+// Write to the UART, tapping what is written
+func (context *Context) uartWrite(data []byte) (n int, err error) {
+	context.tap("tx", data)
+	return context.uartWriteFn(data)
+}
+
+// Read from the UART, tapping what is read
+func (context *Context) uartRead(data []byte) (n int, err error) {
+	n, err = context.uartReadFn(data)
+	if n > 0 {
+		context.tap("rx", data[:n])
+	}
+	return
+}
+
+// Get the maximum length of an I2C chunk
+func (context *Context) i2cChunkMax() int {
+	if context.pacingI2CChunkLen > 0 && context.pacingI2CChunkLen < CardI2CMax {
+		return context.pacingI2CChunkLen
+	}
+	return CardI2CMax
+}
+
 // WriteBytes writes a buffer to I2C
 // By design, must not send more than once every 1Ms
 func (context *Context) i2cWriteBytes(buf []byte) (err error) {
@@ -249,6 +794,7 @@ func (context *Context) i2cWriteBytes(buf []byte) (err error) {
 	reg := make([]byte, 1)
 	reg[0] = byte(len(buf))
 	reg = append(reg, buf...)
+	context.tap("tx", reg)
 	err = context.i2cTxFn(context.i2cAddress, reg, nil)
 	if err != nil {
 		err = fmt.Errorf("i2c write: %s", err)
@@ -262,19 +808,24 @@ func (context *Context) i2cReadBytes(datalen int) (outbuf []byte, available int,
 	time.Sleep(1 * time.Millisecond)
 	readbuf := make([]byte, datalen+2)
 	// Retry, for robustness
+	var firstFailure time.Time
 	for i := 0; ; i++ {
 		reg := make([]byte, 2)
 		reg[0] = byte(0)
 		reg[1] = byte(datalen)
+		context.tap("tx", reg)
 		err = context.i2cTxFn(context.i2cAddress, reg, readbuf)
 		if err == nil {
+			context.tap("rx", readbuf)
 			break
 		}
-		if i >= 10 {
+		if i == 0 {
+			firstFailure = time.Now()
+		}
+		if !context.retryRead(i, firstFailure) {
 			err = fmt.Errorf("i2c read: %s", err)
 			return
 		}
-		time.Sleep(2 * time.Millisecond)
 	}
 	if len(readbuf) < 2 {
 		err = fmt.Errorf("i2c read: not enough data (%d < 2)", len(readbuf))
@@ -292,7 +843,7 @@ func (context *Context) i2cReadBytes(datalen int) (outbuf []byte, available int,
 	}
 	if 2 > 2+good {
 		if false {
-			fmt.Printf("i2c read(%d): %v\n", datalen, readbuf)
+			context.debugf("i2c read(%d): %v\n", datalen, readbuf)
 		}
 		err = fmt.Errorf("i2c read: %d bytes returned while expecting %d", good, datalen)
 		return
@@ -301,15 +852,148 @@ func (context *Context) i2cReadBytes(datalen int) (outbuf []byte, available int,
 	return
 }
 
-// Reset the port
+// Determine whether a failed read may be retried under the retry policy, given the number of
+// retries already made and the time of the first failure, waiting before the retry if so
+func (context *Context) retryRead(retries int, firstFailure time.Time) bool {
+	policy := context.RetryPolicy
+	if retries >= policy.MaxRetries {
+		return false
+	}
+	if policy.TotalTimeout > 0 && time.Since(firstFailure) >= policy.TotalTimeout {
+		return false
+	}
+	time.Sleep(time.Duration(policy.BackoffMs) * time.Millisecond)
+	return true
+}
+
+// Reset the port, reopening it with ReopenFn if the reset fails
 func (context *Context) Reset() (err error) {
+
+	if context.ResetFn == nil {
+		return errNotInitialized()
+	}
+	context.resetRequired = false
+	if !context.reopenRequired {
+		err = context.ResetFn(context)
+		if err == nil || context.ReopenFn == nil {
+			return
+		}
+		context.reopenRequired = true
+	}
+
+	// Reopen the port, but not so often as to hammer a device that is absent
+	context.resetRequired = true
+	if time.Now().Before(context.reopenAt) {
+		err = fmt.Errorf("waiting to reopen port %s", ErrCardIo)
+		return
+	}
+	err = context.ReopenFn(context)
+	if err == nil {
+		err = context.ResetFn(context)
+	}
+	if err != nil {
+		context.reopenBackoff *= 2
+		backoffMin := context.ReopenBackoffMin
+		if backoffMin <= 0 {
+			backoffMin = reopenBackoffMinDefault
+		}
+		if context.reopenBackoff < backoffMin {
+			context.reopenBackoff = backoffMin
+		}
+		backoffMax := context.ReopenBackoffMax
+		if backoffMax <= 0 {
+			backoffMax = reopenBackoffMaxDefault
+		}
+		if context.reopenBackoff > backoffMax {
+			context.reopenBackoff = backoffMax
+		}
+		context.reopenAt = time.Now().Add(context.reopenBackoff)
+		err = fmt.Errorf("error reopening port: %s %s", err, ErrCardIo)
+		return
+	}
 	context.resetRequired = false
-	return context.ResetFn(context)
+	context.reopenRequired = false
+	context.reopenBackoff = 0
+
+	// Done
+	return
+
+}
+
+// RecoverBus attempts to clear a wedged I2C bus, such as one whose SDA line is being held low
+// by a device left mid-transfer, using the function supplied to OpenI2CWithRecovery, and then
+// resets the port.  A Reset alone can't help in this case because no transfer can succeed.
+func (context *Context) RecoverBus() (err error) {
+
+	if context.i2cRecoverFn == nil {
+		err = fmt.Errorf("bus recovery requires a context opened with OpenI2CWithRecovery")
+		return
+	}
+
+	transBegin(false)
+	err = context.i2cRecoverFn()
+	if err != nil {
+		err = fmt.Errorf("i2c bus recovery: %s %s", err, ErrCardIo)
+		context.resetRequired = true
+	} else {
+		err = context.Reset()
+	}
+	transEnd()
+
+	// Done
+	return
+
+}
+
+// Probe resets the port and verifies that the card answers a request
+func (context *Context) Probe() (err error) {
+	transBegin(false)
+	err = context.Reset()
+	transEnd()
+	if err != nil {
+		return
+	}
+	_, err = context.Transaction(NewRequest("card.version"))
+	return
+}
+
+// WaitReady waits up to timeout for the card to answer a Probe, such as after it restarts
+func (context *Context) WaitReady(timeout time.Duration) (err error) {
+	began := time.Now()
+	for {
+		err = context.Probe()
+		if err == nil || time.Since(began) >= timeout {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Flush drains any input pending from the card, such as the remainder of a reply to an
+// abandoned request.  This is lighter-weight than a Reset, and is safe to call between transactions.
+func (context *Context) Flush() (err error) {
+	if context.FlushFn == nil {
+		return errNotInitialized()
+	}
+	transBegin(false)
+	err = context.FlushFn(context)
+	transEnd()
+	return
 }
 
-// Close the port
+// Close the port, first flushing any environment variables buffered by EnvSetBuffered and
+// cancelling any sync pending from SyncAfterIdle
 func (context *Context) Close() {
-	context.CloseFn(context)
+	context.idleLock.Lock()
+	if context.idleTimer != nil {
+		context.idleTimer.Stop()
+		context.idleTimer = nil
+	}
+	context.idleLock.Unlock()
+	context.EnvFlush()
+	if context.CloseFn != nil {
+		context.CloseFn(context)
+	}
 }
 
 // Close serial
@@ -343,6 +1027,26 @@ func NewBody() (body map[string]interface{}) {
 	return make(map[string]interface{})
 }
 
+// Body creates a new body from alternating keys and values, as of the form
+// body, err := tinynote.Body("temp", 22.5, "humidity", 60)
+func Body(keysAndValues ...interface{}) (body map[string]interface{}, err error) {
+	if len(keysAndValues)%2 != 0 {
+		err = fmt.Errorf("body: odd number of arguments (%d); keys and values must be paired", len(keysAndValues))
+		return
+	}
+	body = NewBody()
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key, isString := keysAndValues[i].(string)
+		if !isString {
+			body = nil
+			err = fmt.Errorf("body: key at argument %d is %T rather than string", i, keysAndValues[i])
+			return
+		}
+		body[key] = keysAndValues[i+1]
+	}
+	return
+}
+
 // Request performs a card transaction with a JSON structure and doesn't return a response
 // (This is for semantic compatibility with other languages.)
 func (context *Context) Request(req map[string]interface{}) (err error) {
@@ -361,8 +1065,49 @@ func (context *Context) Response() (rsp map[string]interface{}, err error) {
 	return context.Transaction(nil)
 }
 
-// Transaction performs a card transaction with a JSON structure
+// Transaction performs a card transaction with a JSON structure.  If the card returns an error,
+// the response is returned along with it, so that any partial results may be inspected.
 func (context *Context) Transaction(req map[string]interface{}) (rsp map[string]interface{}, err error) {
+	return context.TransactionWithContext(gocontext.Background(), req)
+}
+
+// TransactionWithContext performs a card transaction with a JSON structure, abandoning it if ctx
+// is canceled or its deadline passes, such as by a watchdog.  The transports check for
+// cancellation between the segments and chunks that they transmit and receive, so an abandoned
+// transaction returns promptly, after which the port is reset before the next transaction
+// because the card may still be responding.  Cancellation doesn't interrupt the wait for
+// another caller's transaction to complete.
+func (context *Context) TransactionWithContext(ctx gocontext.Context, req map[string]interface{}) (rsp map[string]interface{}, err error) {
+	return context.transaction(req, TransactionOptions{ctx: ctx})
+}
+
+// Perform a card transaction with a JSON structure, combining card errors and transport errors
+func (context *Context) transaction(req map[string]interface{}, opts TransactionOptions) (rsp map[string]interface{}, err error) {
+
+	// Perform the transaction
+	rsp, cardErr, transportErr := context.transactionResult(req, opts)
+	err2 := transportErr
+	if err2 == nil {
+		err2 = cardErr
+	}
+	if err2 != nil {
+		err = fmt.Errorf("error from TransactionJSON: %s", err2)
+		return
+	}
+
+	// Done
+	return
+}
+
+// TransactionResult performs a card transaction with a JSON structure, separately returning
+// cardErr when the card returned a well-formed response containing an error, and transportErr
+// when the transaction itself failed because of an I/O error or a garbled response.
+func (context *Context) TransactionResult(req map[string]interface{}) (rsp map[string]interface{}, cardErr error, transportErr error) {
+	return context.transactionResult(req, TransactionOptions{})
+}
+
+// Perform a card transaction with a JSON structure, modified by the specified options
+func (context *Context) transactionResult(req map[string]interface{}, opts TransactionOptions) (rsp map[string]interface{}, cardErr error, transportErr error) {
 
 	// Handle the special case where we are just processing a response
 	var reqJSON []byte
@@ -373,55 +1118,196 @@ func (context *Context) Transaction(req map[string]interface{}) (rsp map[string]
 	} else {
 
 		// Marshal the request to JSON
-		reqJSON, _ = ObjectToJSON(req)
-
-	}
+		reqJSON, transportErr = ObjectToJSON(req)
+		if transportErr != nil {
+			return
+		}
 
-	// Perform the transaction
-	rspJSON, err2 := context.TransactionJSON(reqJSON)
-	if err2 != nil {
-		err = fmt.Errorf("error from TransactionJSON: %s", err2)
-		return
 	}
 
-	// Unmarshal for convenience of the caller
-	rsp, err = JSONToObject(rspJSON)
-	if err != nil {
-		err = fmt.Errorf("error unmarshaling reply from module: %s %s", err, ErrCardIo)
-		return
-	}
+	// Perform the transaction, supplying the request so that it needn't be parsed again
+	_, rsp, cardErr, transportErr = context.transactionJSON(req, reqJSON, opts)
 
 	// Done
 	return
 }
 
-// TransactionJSON performs a card transaction using raw JSON []bytes
-func (context *Context) TransactionJSON(reqJSON []byte) (rspJSON []byte, err error) {
-
-	// Unmarshal the request to peek inside it.  Also, accept a zero-length request as a valid case
-	// because we use this in the test fixture where  we just accept pure responses w/o requests.
-	var req map[string]interface{}
-	var noResponseRequested bool
+// TransactionWithOpts performs a card transaction with a JSON structure, modified by the specified options
+func (context *Context) TransactionWithOpts(req map[string]interface{}, opts TransactionOptions) (rsp map[string]interface{}, err error) {
 
-	// Make sure that it is valid JSON, because the transports won't validate this
-	// and they may misbehave if they do not get a valid JSON response back.
-	req, err = JSONToObject(reqJSON)
-	if err != nil {
-		return
+	// Tag the request with an ID, copying it so as not to modify the caller's map
+	var requestID uint32
+	if opts.AutoID && req != nil {
+		if context.RequestIDFn != nil {
+			requestID = context.RequestIDFn()
+		} else {
+			requestID = atomic.AddUint32(&context.lastRequestID, 1)
+		}
+		reqWithID := map[string]interface{}{}
+		for k, v := range req {
+			reqWithID[k] = v
+		}
+		reqWithID["id"] = requestID
+		req = reqWithID
+		opts.checkID = true
+		opts.requestID = requestID
 	}
 
-	// If this is a hub.set, generate a user agent object if one hasn't already been supplied
-	if !context.DisableUA && (req["req"] == "hub.set" || req["cmd"] == "hub.set") && req["body"] == nil {
-		ua := context.UserAgent()
-		if ua != nil {
-			req["body"] = ua
-			reqJSON, _ = ObjectToJSON(req)
+	// Perform the transaction, waiting out any firmware update that the card is performing
+	rsp, err = context.transaction(req, opts)
+	if opts.DFUWait > 0 {
+		deadline := time.Now().Add(opts.DFUWait)
+		for IsInDFU(err) && context.waitDFU(deadline) {
+			rsp, err = context.transaction(req, opts)
+		}
+	}
+
+	// Done
+	return
+
+}
+
+// TransactionDeadline performs a card transaction with a JSON structure, retrying after any
+// I/O error (with the reset that follows it) for as long as the deadline hasn't passed, and
+// returning the last error if it does.  An error returned by the card itself is not retried.
+// At least one attempt is made, even if the deadline has already passed.
+func (context *Context) TransactionDeadline(req map[string]interface{}, deadline time.Time) (rsp map[string]interface{}, err error) {
+
+	for {
+		var cardErr, transportErr error
+		rsp, cardErr, transportErr = context.TransactionResult(req)
+		if transportErr == nil {
+			if cardErr != nil {
+				err = fmt.Errorf("error from TransactionJSON: %s", cardErr)
+			}
+			return
+		}
+		rsp = nil
+		err = fmt.Errorf("error from TransactionJSON: %s", transportErr)
+		if time.Now().Add(transactionRetryDelay).After(deadline) {
+			return
+		}
+		time.Sleep(transactionRetryDelay)
+	}
+
+}
+
+// SetAndVerify performs setReq and then getReq, confirming that the specified field of the
+// response to getReq has the expected value, such as when verifying provisioning.  Numbers are
+// compared by value, so the expected value may be of any numeric type.  Only scalar values
+// (numbers, strings, booleans, and nil for an absent field) may be compared.
+func (context *Context) SetAndVerify(setReq map[string]interface{}, getReq map[string]interface{}, field string, expected interface{}) (err error) {
+
+	err = context.Request(setReq)
+	if err != nil {
+		return
+	}
+	rsp, err := context.Transaction(getReq)
+	if err != nil {
+		return
+	}
+	actual := rsp[field]
+	if !valuesEqual(actual, expected) {
+		err = fmt.Errorf("%s: %s is %v after setting it to %v", stringField(getReq, "req"), field, actual, expected)
+		return
+	}
+
+	// Done
+	return
+
+}
+
+// TransactionJSON performs a card transaction using raw JSON []bytes
+func (context *Context) TransactionJSON(reqJSON []byte) (rspJSON []byte, err error) {
+	rspJSON, _, cardErr, err := context.transactionJSON(nil, reqJSON, TransactionOptions{})
+	if err == nil {
+		err = cardErr
+	}
+	return
+}
+
+// TransactionJSONParsed is an advanced form of TransactionJSON for high-rate loops, in which the
+// caller supplies req as the already-decoded form of reqJSON so that the request needn't be parsed
+// again.  The caller is responsible for ensuring that reqJSON is valid JSON that matches req,
+// because neither is validated.  req is not modified.
+func (context *Context) TransactionJSONParsed(reqJSON []byte, req map[string]interface{}) (rspJSON []byte, err error) {
+	if req == nil {
+		err = fmt.Errorf("TransactionJSONParsed: no parsed request supplied")
+		return
+	}
+	rspJSON, _, cardErr, err := context.transactionJSON(req, reqJSON, TransactionOptions{})
+	if err == nil {
+		err = cardErr
+	}
+	return
+}
+
+// TransactionBuf performs a card transaction with a JSON structure, reading the response JSON
+// into rspBuf rather than allocating a buffer for it, and returning its length.  The response
+// is still decoded so that errors can be detected.  If the response doesn't fit within the
+// length of rspBuf, the transaction fails and the remainder of the response is discarded.
+func (context *Context) TransactionBuf(req map[string]interface{}, rspBuf []byte) (n int, err error) {
+
+	reqJSON, err := ObjectToJSON(req)
+	if err != nil {
+		return
+	}
+	rspJSON, _, cardErr, err := context.transactionJSON(req, reqJSON, TransactionOptions{rspBuf: rspBuf[:0:len(rspBuf)]})
+	if err == nil {
+		err = cardErr
+	}
+	if err != nil {
+		return
+	}
+	if len(rspJSON) > len(rspBuf) {
+		err = fmt.Errorf("response buffer too small (need %d)", len(rspJSON))
+		return
+	}
+	n = copy(rspBuf, rspJSON)
+
+	// Done
+	return
+
+}
+
+// Perform a card transaction using raw JSON []bytes, returning the decoded response as well.
+// If req is supplied, it is trusted to be the decoded form of reqJSON.
+func (context *Context) transactionJSON(req map[string]interface{}, reqJSON []byte, opts TransactionOptions) (rspJSON []byte, rsp map[string]interface{}, cardErr error, err error) {
+
+	// Unmarshal the request to peek inside it.  Also, accept a zero-length request as a valid case
+	// because we use this in the test fixture where  we just accept pure responses w/o requests.
+	var noResponseRequested bool
+
+	// Make sure that it is valid JSON, because the transports won't validate this
+	// and they may misbehave if they do not get a valid JSON response back.
+	if req == nil {
+		req, err = JSONToObject(reqJSON)
+		if err != nil {
+			return
+		}
+	}
+
+	// If this is a hub.set, generate a user agent object if one hasn't already been supplied,
+	// copying the request because it may belong to the caller
+	if !context.DisableUA && (req["req"] == "hub.set" || req["cmd"] == "hub.set") && req["body"] == nil {
+		ua := context.UserAgent()
+		if ua != nil {
+			reqWithUA := map[string]interface{}{}
+			for k, v := range req {
+				reqWithUA[k] = v
+			}
+			reqWithUA["body"] = ua
+			req = reqWithUA
+			reqJSON, err = ObjectToJSON(req)
+			if err != nil {
+				return
+			}
 		}
 	}
 
 	// Determine whether or not a response will be expected from the notecard by
 	// examining the req and cmd fields
-	noResponseRequested = req["req"] == "" && req["cmd"] != ""
+	noResponseRequested = stringField(req, "req") == "" && stringField(req, "cmd") != ""
 
 	// Make sure that the JSON has a single \n terminator
 	for {
@@ -440,71 +1326,304 @@ func (context *Context) TransactionJSON(reqJSON []byte) (rspJSON []byte, err err
 	// Debug
 	if context.Debug {
 		var j []byte
-		j, _ = ObjectToJSON(req)
-		fmt.Printf("%s\n", string(j))
+		j, err = ObjectToJSON(req)
+		if err != nil {
+			return
+		}
+		context.debugf("%s\n", string(j))
 	}
 
 	// Only one caller at a time accessing the I/O port
-	transLock.Lock()
+	transBegin(opts.Priority)
 
-	// Do a reset if one was pending
-	if context.resetRequired {
-		context.Reset()
+	// Do a reset if one was pending, failing without any I/O if the port couldn't be reopened
+	if context.resetRequired && !opts.SkipReset {
+		resetErr := context.Reset()
+		if context.reopenRequired {
+			err = resetErr
+		}
 	}
 
-	// Perform the transaction
-	rspJSON, err = context.TransactionFn(context, noResponseRequested, reqJSON)
-	if err != nil {
+	// Wait until the card may be accessed again
+	if err == nil {
+		err = context.takeRateToken()
+	}
+	context.pace()
+
+	// Perform the transaction, unless a fault is being injected
+	if err == nil && context.FaultFn != nil {
+		err = context.FaultFn(reqJSON)
+	}
+	if err == nil && context.TransactionFn == nil {
+		err = errNotInitialized()
+	}
+	if err == nil {
+		context.transCtx = opts.ctx
+		err = context.transCanceled()
+	}
+	var elapsed time.Duration
+	if err == nil {
+		context.rspBuf = opts.rspBuf
+		began := time.Now()
+		if context.crcEnabled && len(reqJSON) > 1 {
+			rspJSON, err = context.transactionCRC(noResponseRequested, reqJSON)
+		} else {
+			rspJSON, err = context.TransactionFn(context, noResponseRequested, reqJSON)
+		}
+		elapsed = time.Since(began)
+		context.rspBuf = nil
+	}
+	context.transCtx = nil
+	if errorRequiresReset(err, false) {
 		context.resetRequired = true
 	}
 
+	// If the response is garbled, the remainder of it may still be in flight and would be
+	// mistaken for the reply to the next request, so make sure that the port is drained.
+	if err == nil && !noResponseRequested {
+		if opts.fieldsOnly != nil {
+			rsp, err = jsonFieldsOnly(rspJSON, opts.fieldsOnly)
+		} else {
+			rsp, err = JSONToObject(rspJSON)
+		}
+		if err != nil {
+			err = fmt.Errorf("error unmarshaling reply from module: %s %s", err, ErrCardIo)
+			context.resetRequired = true
+			if context.DrainOnCorruption {
+				context.Reset()
+			}
+		}
+	}
+	if err == nil && IsError(nil, rsp) && errorRequiresReset(fmt.Errorf("%s", ErrorString(nil, rsp)), true) {
+		context.resetRequired = true
+	}
+
+	// A response to some other request means that the stream is out of sync
+	if err == nil && opts.checkID && !noResponseRequested {
+		responseID, present := numberField(rsp, "id")
+		if !present || uint32(responseID) != opts.requestID {
+			err = fmt.Errorf("response id %v doesn't match request id %d %s", rsp["id"], opts.requestID, ErrCardIo)
+			context.resetRequired = true
+		}
+	}
+
+	// Back off if the device is being rate-limited
+	if context.AutoBackoff {
+		context.adjustBackoff(err == nil && !IsError(nil, rsp), err == nil && strings.Contains(ErrorString(nil, rsp), ErrRateLimited))
+	}
+
 	// If this was a card restore, we want to hold everyone back if we reset the card
 	if req["req"] == "card.restore" || req["req"] == "card.restart" {
-		time.Sleep(8 * time.Second)
+		if !opts.noRestartDelay {
+			time.Sleep(8 * time.Second)
+		}
+		if context.i2cAddressPending != 0 {
+			context.i2cAddress = context.i2cAddressPending
+			context.i2cAddressPending = 0
+		}
 	}
-	transLock.Unlock()
+	transEnd()
 
 	// If no response, we're done
 	if noResponseRequested {
-		rspJSON = []byte("{}")
+		if err == nil {
+			rspJSON = []byte("{}")
+			rsp = map[string]interface{}{}
+			context.transactionHousekeeping(req, nil)
+		}
+		context.countTransaction(elapsed, err)
 		return
 	}
 
-	// Decode the response to create an error if the transaction returned an error.  We
+	// Use the decoded response to create an error if the transaction returned an error.  We
 	// do this because it's SUPER inconvenient to always be checking for a response error
 	// vs an error on the transaction itself
-	rsp := map[string]interface{}{}
-	if err == nil {
-		rsp, err = JSONToObject(rspJSON)
-	}
 	if IsError(err, rsp) {
-		if req["req"] == "" {
-			err = fmt.Errorf("%s", ErrorString(err, rsp))
+		errstr := ErrorString(err, rsp)
+		if req["req"] != "" && req["req"] != nil {
+			errstr = fmt.Sprintf("%s: %s", req["req"], errstr)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s", errstr)
 		} else {
-			err = fmt.Errorf("%s: %s", req["req"], ErrorString(err, rsp))
+			cardErr = fmt.Errorf("%s", errstr)
 		}
 	}
 
 	// Debug
 	if context.Debug {
-		fmt.Printf("%s", string(rspJSON))
+		context.debugf("%s", string(rspJSON))
+	}
+
+	// Perform any housekeeping that follows the request
+	if err == nil {
+		context.transactionHousekeeping(req, cardErr)
+		context.countTransaction(elapsed, cardErr)
+	} else {
+		context.countTransaction(elapsed, err)
+	}
+
+	// Done
+	return
+
+}
+
+// Perform any housekeeping that follows the addition of a note, or the failure to add one
+// because storage is full
+func (context *Context) transactionHousekeeping(req map[string]interface{}, cardErr error) {
+	if req["req"] == "note.add" || req["cmd"] == "note.add" {
+		if cardErr == nil {
+			context.noteAdded()
+		} else if IsStorageFull(cardErr) {
+			context.storageFull()
+		}
+	}
+}
+
+// Begin a transaction whose request is streamed to the card, or followed by data, rather than
+// transmitted by TransactionFn in one piece.  The I/O port is held on return, even if an error
+// is returned, until streamEnd is called.  Because a partially transmitted request can't be
+// retracted, a pending reset must succeed before anything is transmitted.
+func (context *Context) streamBegin(reqJSON []byte, opts TransactionOptions) (began time.Time, err error) {
+
+	transBegin(opts.Priority)
+	if context.resetRequired {
+		err = context.Reset()
+		if err != nil {
+			return
+		}
+	}
+	err = context.takeRateToken()
+	if err != nil {
+		return
+	}
+	context.pace()
+	if context.FaultFn != nil {
+		err = context.FaultFn(reqJSON)
+		if err != nil {
+			return
+		}
+	}
+	if context.TransactionFn == nil {
+		err = errNotInitialized()
+		return
+	}
+	if context.Debug {
+		context.debugf("%s\n", string(reqJSON))
+	}
+	context.transCtx = opts.ctx
+	err = context.transCanceled()
+	began = time.Now()
+
+	// Done
+	return
+
+}
+
+// Complete a transaction begun by streamBegin, releasing the I/O port
+func (context *Context) streamEnd(began time.Time, rspJSON []byte, rsp map[string]interface{}, err error) {
+
+	var elapsed time.Duration
+	if !began.IsZero() {
+		elapsed = time.Since(began)
+	}
+	context.transCtx = nil
+	if errorRequiresReset(err, false) {
+		context.resetRequired = true
+	}
+	if err == nil && IsError(nil, rsp) {
+		err = fmt.Errorf("%s", ErrorString(nil, rsp))
+		if errorRequiresReset(err, true) {
+			context.resetRequired = true
+		}
+	}
+	transEnd()
+	if context.Debug && rspJSON != nil {
+		context.debugf("%s", string(rspJSON))
+	}
+	context.countTransaction(elapsed, err)
+
+}
+
+// Delay until the interval between transactions has elapsed, while holding the I/O port
+func (context *Context) pace() {
+	interval := context.MinTransactionInterval
+	if context.backoffInterval > interval {
+		interval = context.backoffInterval
+	}
+	if interval > 0 && !context.lastTransactionAt.IsZero() {
+		wait := interval - time.Since(context.lastTransactionAt)
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	context.lastTransactionAt = time.Now()
+}
+
+// Consume a token from the RateLimit bucket, waiting for one if necessary, while holding the I/O port
+func (context *Context) takeRateToken() (err error) {
+
+	if context.RateLimit <= 0 {
+		return
+	}
+
+	// Replenish the bucket for the time that has elapsed
+	burst := float64(context.RateLimitBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	if context.rateTokensAt.IsZero() {
+		context.rateTokens = burst
+	} else {
+		context.rateTokens += now.Sub(context.rateTokensAt).Seconds() * context.RateLimit
+		if context.rateTokens > burst {
+			context.rateTokens = burst
+		}
+	}
+	context.rateTokensAt = now
+
+	// Wait for a token if none is available
+	if context.rateTokens < 1 {
+		if context.RateLimitError {
+			err = fmt.Errorf("transaction rate limit of %g per second exceeded %s", context.RateLimit, ErrTransactionRate)
+			return
+		}
+		time.Sleep(time.Duration((1 - context.rateTokens) / context.RateLimit * float64(time.Second)))
+		context.rateTokens = 1
+		context.rateTokensAt = time.Now()
 	}
+	context.rateTokens--
 
 	// Done
 	return
 
 }
 
+// Adjust the interval imposed by AutoBackoff following a transaction, while holding the I/O port
+func (context *Context) adjustBackoff(succeeded bool, rateLimited bool) {
+	if succeeded {
+		context.backoffInterval = 0
+		return
+	}
+	if !rateLimited {
+		return
+	}
+	if context.backoffInterval == 0 {
+		context.backoffInterval = rateLimitBackoffInitial
+	} else {
+		context.backoffInterval *= 2
+	}
+	if context.backoffInterval > rateLimitBackoffMax {
+		context.backoffInterval = rateLimitBackoffMax
+	}
+}
+
 // Perform a card transaction over serial under the assumption that request already has '\n' terminator
 func cardTransactionSerial(context *Context, noResponse bool, reqJSON []byte) (rspJSON []byte, err error) {
 
 	// Initialize timing parameters
-	if RequestSegmentMaxLen < 0 {
-		RequestSegmentMaxLen = CardRequestSerialSegmentMaxLen
-	}
-	if RequestSegmentDelayMs < 0 {
-		RequestSegmentDelayMs = CardRequestSerialSegmentDelayMs
-	}
+	segmentMaxLen, segmentDelayMs := context.requestSegmentParams(CardRequestSerialSegmentMaxLen, CardRequestSerialSegmentDelayMs)
 
 	// Handle the special case where we are looking only for a reply
 	if len(reqJSON) > 0 {
@@ -514,10 +1633,10 @@ func cardTransactionSerial(context *Context, noResponse bool, reqJSON []byte) (r
 		segLeft := len(reqJSON)
 		for {
 			segLen := segLeft
-			if segLen > RequestSegmentMaxLen {
-				segLen = RequestSegmentMaxLen
+			if segLen > segmentMaxLen {
+				segLen = segmentMaxLen
 			}
-			_, err = context.uartWriteFn(reqJSON[segOff : segOff+segLen])
+			_, err = context.uartWrite(reqJSON[segOff : segOff+segLen])
 			if err != nil {
 				err = fmt.Errorf("error transmitting to module: %s %s", err, ErrCardIo)
 				context.cardReportError(err)
@@ -528,7 +1647,11 @@ func cardTransactionSerial(context *Context, noResponse bool, reqJSON []byte) (r
 			if segLeft == 0 {
 				break
 			}
-			time.Sleep(time.Duration(RequestSegmentDelayMs) * time.Millisecond)
+			context.serialSegmentWait(segmentDelayMs)
+			err = context.transCanceled()
+			if err != nil {
+				return
+			}
 		}
 
 	}
@@ -538,29 +1661,73 @@ func cardTransactionSerial(context *Context, noResponse bool, reqJSON []byte) (r
 		return
 	}
 
-	// Read the reply until we get '\n' at the end
-	waitBeganSecs := time.Now().Unix()
+	// Read the reply until we get '\n' at the end, directly into the caller's buffer if supplied
+	var retries int
+	var firstFailure time.Time
+	var buf []byte
+	if context.rspBuf == nil {
+		buf = make([]byte, 2048)
+	}
+	rspJSON = context.rspBuf
 	for {
+		err = context.transCanceled()
+		if err != nil {
+			return
+		}
+		if context.rspBuf != nil {
+			buf = rspJSON[len(rspJSON):cap(rspJSON)]
+			if len(buf) == 0 {
+				err = fmt.Errorf("response exceeds %d-byte buffer %s", cap(rspJSON), ErrCardIo)
+				context.cardReportError(err)
+				return
+			}
+		}
 		var length int
-		buf := make([]byte, 2048)
-		length, err = context.uartReadFn(buf)
+		length, err = context.uartRead(buf)
 		if err != nil {
 			if err == io.EOF {
 				// Just a read timeout
 				continue
 			}
-			// Ignore [flaky] hardware errors for up to several seconds
-			if (time.Now().Unix() - waitBeganSecs) > 2 {
+			// Ignore [flaky] hardware errors for as long as the retry policy allows
+			if retries == 0 {
+				firstFailure = time.Now()
+			}
+			if !context.retryRead(retries, firstFailure) {
 				err = fmt.Errorf("error reading from module: %s %s", err, ErrCardIo)
 				context.cardReportError(err)
 				return
 			}
-			time.Sleep(1 * time.Second)
+			retries++
 			continue
 		}
+		if context.MaxResponseBytes > 0 && len(rspJSON)+length > context.MaxResponseBytes {
+			err = fmt.Errorf("response exceeds %d bytes %s", context.MaxResponseBytes, ErrCardIo)
+			context.cardReportError(err)
+			return
+		}
+
+		// Grow the response in bounded steps rather than letting append double it, and give
+		// the rest of the system (including the garbage collector) a chance to run
+		if len(rspJSON)+length > cap(rspJSON) {
+			growth := len(rspJSON) + length
+			if growth > serialResponseGrowthMax {
+				growth = serialResponseGrowthMax
+			}
+			if growth < length {
+				growth = length
+			}
+			grown := make([]byte, len(rspJSON), cap(rspJSON)+growth)
+			copy(grown, rspJSON)
+			rspJSON = grown
+			runtime.Gosched()
+		}
 		rspJSON = append(rspJSON, buf[:length]...)
-		if strings.HasSuffix(string(rspJSON), "\n") {
-			break
+		if len(rspJSON) > 0 && rspJSON[len(rspJSON)-1] == '\n' {
+			rspJSON = context.routeTraceLines(rspJSON)
+			if len(rspJSON) > 0 {
+				break
+			}
 		}
 	}
 
@@ -569,15 +1736,38 @@ func cardTransactionSerial(context *Context, noResponse bool, reqJSON []byte) (r
 
 }
 
+// Return an I/O error if the caller has canceled the transaction in progress, so that the
+// port will be reset before the next transaction
+func (context *Context) transCanceled() (err error) {
+	if context.transCtx == nil || context.transCtx.Err() == nil {
+		return
+	}
+	err = fmt.Errorf("transaction canceled: %s %s", context.transCtx.Err(), ErrCardIo)
+	return
+}
+
+// Wait between serial segments until the card is ready or the delay has elapsed
+func (context *Context) serialSegmentWait(delayMs int) {
+	delay := time.Duration(delayMs) * time.Millisecond
+	if context.SerialReadyFn == nil {
+		time.Sleep(delay)
+		return
+	}
+	began := time.Now()
+	for !context.SerialReadyFn() && time.Since(began) < delay {
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
 // Perform a card transaction over I2C under the assumption that request already has '\n' terminator
 func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJSON []byte, err error) {
 
 	// Initialize timing parameters
-	if RequestSegmentMaxLen < 0 {
-		RequestSegmentMaxLen = CardRequestI2CSegmentMaxLen
-	}
-	if RequestSegmentDelayMs < 0 {
-		RequestSegmentDelayMs = CardRequestI2CSegmentDelayMs
+	segmentMaxLen, segmentDelayMs := context.requestSegmentParams(CardRequestI2CSegmentMaxLen, CardRequestI2CSegmentDelayMs)
+
+	// Give the card time to process any command that was just transmitted
+	if wait := time.Until(context.i2cQuietUntil); wait > 0 {
+		time.Sleep(wait)
 	}
 
 	// Transmit the request in chunks, but also in segments so as not to overwhelm the notecard's interrupt buffers
@@ -585,7 +1775,11 @@ func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJ
 	jsonbufLen := len(reqJSON)
 	sentInSegment := 0
 	for jsonbufLen > 0 {
-		chunklen := CardI2CMax
+		err = context.transCanceled()
+		if err != nil {
+			return
+		}
+		chunklen := context.i2cChunkMax()
 		if jsonbufLen < chunklen {
 			chunklen = jsonbufLen
 		}
@@ -597,11 +1791,18 @@ func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJ
 		chunkoffset += chunklen
 		jsonbufLen -= chunklen
 		sentInSegment += chunklen
-		if sentInSegment > RequestSegmentMaxLen {
+		if sentInSegment > segmentMaxLen {
 			sentInSegment = 0
-			time.Sleep(time.Duration(RequestSegmentDelayMs) * time.Millisecond)
+			time.Sleep(time.Duration(segmentDelayMs) * time.Millisecond)
 		}
-		time.Sleep(time.Duration(RequestSegmentDelayMs) * time.Millisecond)
+
+		// Rather than delaying the caller after the final chunk of a command, hold off
+		// whatever is next transmitted
+		if jsonbufLen == 0 && noResponse {
+			context.i2cQuietUntil = time.Now().Add(time.Duration(segmentDelayMs) * time.Millisecond)
+			break
+		}
+		time.Sleep(time.Duration(segmentDelayMs) * time.Millisecond)
 	}
 
 	// If no response, we're done
@@ -612,12 +1813,19 @@ func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJ
 	// Loop, building a reply buffer out of received chunks.  We'll build the reply in the same
 	// buffer we used to transmit, and will grow it as necessary.
 	jsonbufLen = 0
+	rspJSON = context.rspBuf
 	receivedNewline := false
 	chunklen := 0
 	expireSecs := 60
-	expires := time.Now().Add(time.Duration(expireSecs) * time.Second)
+	waitBegan := time.Now()
 	for {
 
+		// Stop if the caller has given up
+		err = context.transCanceled()
+		if err != nil {
+			return
+		}
+
 		// Read the next chunk
 		readbuf, available, err2 := context.i2cReadBytes(chunklen)
 		if err2 != nil {
@@ -626,13 +1834,22 @@ func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJ
 		}
 
 		// Append to the JSON being accumulated
+		if context.MaxResponseBytes > 0 && len(rspJSON)+len(readbuf) > context.MaxResponseBytes {
+			err = fmt.Errorf("response exceeds %d bytes %s", context.MaxResponseBytes, ErrCardIo)
+			return
+		}
+		if context.rspBuf != nil && len(rspJSON)+len(readbuf) > cap(context.rspBuf) {
+			err = fmt.Errorf("response exceeds %d-byte buffer %s", cap(context.rspBuf), ErrCardIo)
+			return
+		}
 		rspJSON = append(rspJSON, readbuf...)
 		readlen := len(readbuf)
 		jsonbufLen += readlen
 
 		// If we received something, reset the expiration
 		if readlen > 0 {
-			expires = time.Now().Add(time.Duration(90) * time.Second)
+			waitBegan = time.Now()
+			expireSecs = 90
 		}
 
 		// If the last byte of the chunk is \n, chances are that we're done.  However, just so
@@ -644,8 +1861,8 @@ func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJ
 
 		// For the next iteration, reaad the min of what's available and what we're permitted to read
 		chunklen = available
-		if chunklen > CardI2CMax {
-			chunklen = CardI2CMax
+		if chunklen > context.i2cChunkMax() {
+			chunklen = context.i2cChunkMax()
 		}
 
 		// If there's something available on the notecard for us to receive, do it
@@ -653,8 +1870,20 @@ func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJ
 			continue
 		}
 
-		// If there's nothing available and we received a newline, we're done
+		// If there's nothing available and we received a newline, we're done unless all that
+		// we received was trace output
 		if receivedNewline {
+			rspJSON = context.routeTraceLines(rspJSON)
+			jsonbufLen = len(rspJSON)
+			if jsonbufLen > 0 {
+				break
+			}
+			receivedNewline = false
+		}
+
+		// Newline is the primary signal of completion, but some firmware omits it, so with
+		// nothing more available we also accept a complete JSON object rather than waiting
+		if jsonComplete(rspJSON) {
 			break
 		}
 
@@ -662,7 +1891,7 @@ func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJ
 		expired := false
 		timeoutSecs := 0
 		if jsonbufLen == 0 {
-			expired = time.Now().After(expires)
+			expired = time.Since(waitBegan) > time.Duration(expireSecs)*time.Second
 			timeoutSecs = expireSecs
 		}
 		if expired {
@@ -676,6 +1905,27 @@ func cardTransactionI2C(context *Context, noResponse bool, reqJSON []byte) (rspJ
 	return
 }
 
+// Deliver any complete lines of trace output preceding the response to TraceFn, returning
+// what remains.  Everything is left in place if there is no TraceFn.
+func (context *Context) routeTraceLines(rspJSON []byte) (remaining []byte) {
+	remaining = rspJSON
+	for context.TraceFn != nil {
+		eol := bytes.IndexByte(remaining, '\n')
+		if eol < 0 {
+			break
+		}
+		line := bytes.TrimSpace(remaining[:eol])
+		if len(line) > 0 && line[0] == '{' {
+			break
+		}
+		if len(line) > 0 {
+			context.TraceFn(string(line))
+		}
+		remaining = remaining[eol+1:]
+	}
+	return
+}
+
 // IsError tests to see if a response contains an error
 func IsError(err error, rsp map[string]interface{}) bool {
 	if err != nil {
@@ -712,6 +1962,94 @@ func ErrorContains(err error, errKeyword string) bool {
 	return strings.Contains(fmt.Sprintf("%s", err), errKeyword)
 }
 
+// ErrorCodes returns the error keywords within an error, such as "{io}", in the order they appear
+func ErrorCodes(err error) (codes []string) {
+	if err == nil {
+		return
+	}
+	errstr := fmt.Sprintf("%s", err)
+	for {
+		left := strings.SplitN(errstr, "{", 2)
+		if len(left) == 1 {
+			break
+		}
+		b := strings.SplitN(left[1], "}", 2)
+		if len(b) == 1 {
+			break
+		}
+		codes = append(codes, "{"+b[0]+"}")
+		errstr = b[1]
+	}
+	return
+}
+
+// Determine whether an error carries the specified error keyword
+func errorHasCode(err error, code string) bool {
+	for _, c := range ErrorCodes(err) {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTemplateMismatch tests to see if an error indicates that a note was rejected because
+// its body doesn't match the template defined for its notefile
+func IsTemplateMismatch(err error) bool {
+	return errorHasCode(err, ErrTemplateIncompatible)
+}
+
+// IsDelayed tests to see if an error indicates that the card accepted the request but is
+// processing it asynchronously, as with some GPS and network operations.  This is not a
+// failure and doesn't cause a reset; rather, the caller should poll for completion by
+// periodically reissuing the request (or its status request) until it no longer reports
+// that it is delayed.
+func IsDelayed(err error) bool {
+	return errorHasCode(err, ErrDelayed)
+}
+
+// IsStorageFull tests to see if an error indicates that the card's storage is full, in which
+// case notes must not be added until a sync has moved those pending to Notehub.  If
+// AutoSyncStorageThreshold is set, the sync is started automatically.
+func IsStorageFull(err error) bool {
+	return errorHasCode(err, ErrStorageFull)
+}
+
+// IsRateLimited tests to see if an error indicates that Notehub is throttling the device for
+// making too many requests.  The device should back off rather than retrying immediately, for
+// example by doubling the delay before each retry while the error persists, because requests
+// made while rate-limited may extend the penalty.  Setting AutoBackoff does this automatically.
+func IsRateLimited(err error) bool {
+	return errorHasCode(err, ErrRateLimited)
+}
+
+// IsInDFU returns true if the card refused a request because it is updating its firmware.  The
+// request should be retried once the update is complete, which TransactionWithOpts does when
+// DFUWait is specified.
+func IsInDFU(err error) bool {
+	return errorHasCode(err, ErrDFUInProgress)
+}
+
+// Determine whether an error indicates that the I/O stream may be out of sync.  A transport
+// error does so unless it carries only card error keywords.  An error reported by the card in a
+// well-formed response, such as {note-noexist}, leaves the port in a known state and so doesn't
+// warrant the expense of a reset, unless the card reports that the request reached it garbled.
+func errorRequiresReset(err error, reportedByCard bool) bool {
+	if err == nil {
+		return false
+	}
+	codes := ErrorCodes(err)
+	if len(codes) == 0 {
+		return !reportedByCard
+	}
+	for _, code := range codes {
+		if code == ErrCardIo || code == ErrTimeout {
+			return true
+		}
+	}
+	return false
+}
+
 // ErrorClean removes all error keywords from an error string
 func ErrorClean(err error) error {
 	errstr := fmt.Sprintf("%s", err)
@@ -731,12 +2069,16 @@ func ErrorClean(err error) error {
 
 // ErrorJSON returns a JSON object with nothing but an error code, and with an optional message
 func ErrorJSON(message string, err error) (rspJSON []byte) {
-	if message == "" {
-		rspJSON = []byte(fmt.Sprintf("{\"err\":\"%q\"}", err))
-	} else if err == nil {
-		rspJSON = []byte(fmt.Sprintf("{\"err\":\"%q\"}", message))
-	} else {
-		rspJSON = []byte(fmt.Sprintf("{\"err\":\"%q: %q\"}", message, err))
+	errstr := message
+	if err != nil {
+		if errstr != "" {
+			errstr += ": "
+		}
+		errstr += err.Error()
 	}
+
+	// A string always encodes, so quote it directly rather than discarding an encoding error
+	format := jsonFormat{noteGo: NoteGoCompatibleJSON}
+	rspJSON = []byte("{\"err\":" + format.quote(errstr) + "}")
 	return
 }
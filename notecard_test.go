@@ -0,0 +1,331 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Open a context whose card is simulated by respond, which is given each request as it is
+// transmitted and returns the card's response
+func newTestContext(respond func(reqJSON []byte) (rspJSON []byte, err error)) (context *Context) {
+	context, _ = OpenUART(nil, nil)
+	context.DisableUA = true
+	context.ResetFn = func(context *Context) error {
+		return nil
+	}
+	context.TransactionFn = func(context *Context, noResponse bool, reqJSON []byte) ([]byte, error) {
+		return respond(reqJSON)
+	}
+	return
+}
+
+func TestResetRequiredAfterTransportError(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return nil, fmt.Errorf("read failed %s", ErrCardIo)
+	})
+	_, err := context.Transaction(NewRequest("card.version"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !context.resetRequired {
+		t.Errorf("an I/O error should require a reset")
+	}
+}
+
+func TestResetNotRequiredAfterCardError(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte("{\"err\":\"no notes available in queue {note-noexist}\"}\n"), nil
+	})
+	_, err := context.Transaction(NewRequest("note.get"))
+	if !errorHasCode(err, ErrNoteNoExist) {
+		t.Fatalf("expected %s, got %v", ErrNoteNoExist, err)
+	}
+	if context.resetRequired {
+		t.Errorf("a {note-noexist} error from the card should not require a reset")
+	}
+}
+
+func TestResetNotRequiredAfterCardErrorWithoutKeyword(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte("{\"err\":\"unrecognized request\"}\n"), nil
+	})
+	_, err := context.Transaction(NewRequest("card.bogus"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if context.resetRequired {
+		t.Errorf("an error from the card without an I/O keyword should not require a reset")
+	}
+}
+
+func TestResetRequiredAfterCardIoError(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte("{\"err\":\"request is not valid JSON {io}\"}\n"), nil
+	})
+	_, err := context.Transaction(NewRequest("card.version"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !context.resetRequired {
+		t.Errorf("an {io} error reported by the card should require a reset")
+	}
+}
+
+func TestResetRequiredAfterGarbledResponse(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte("{\"version\":\"no"), nil
+	})
+	_, err := context.Transaction(NewRequest("card.version"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !context.resetRequired {
+		t.Errorf("a garbled response should require a reset")
+	}
+}
+
+func TestAutoIDMismatchRequiresReset(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte("{\"id\":999}\n"), nil
+	})
+	_, err := context.TransactionWithOpts(NewRequest("card.version"), TransactionOptions{AutoID: true})
+	if !errorHasCode(err, ErrCardIo) {
+		t.Fatalf("expected an %s error, got %v", ErrCardIo, err)
+	}
+	if !context.resetRequired {
+		t.Errorf("a response to another request should require a reset")
+	}
+}
+
+func TestAutoIDMatch(t *testing.T) {
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		req, err := JSONToObject(reqJSON)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("{\"id\":%d}\n", intField(req, "id"))), nil
+	})
+	_, err := context.TransactionWithOpts(NewRequest("card.version"), TransactionOptions{AutoID: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if context.resetRequired {
+		t.Errorf("a matching response should not require a reset")
+	}
+}
+
+func TestTransactionBuf(t *testing.T) {
+	rspJSON := "{\"version\":\"notecard-5.1.1\"}\n"
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte(rspJSON), nil
+	})
+	rspBuf := make([]byte, 64)
+	n, err := context.TransactionBuf(NewRequest("card.version"), rspBuf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(rspBuf[:n]) != rspJSON {
+		t.Errorf("expected %q, got %q", rspJSON, rspBuf[:n])
+	}
+}
+
+func TestTransactionBufTooSmall(t *testing.T) {
+	rspJSON := "{\"version\":\"notecard-5.1.1\"}\n"
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		return []byte(rspJSON), nil
+	})
+	for _, rspBuf := range [][]byte{nil, make([]byte, 0, 64), make([]byte, 8, 64)} {
+		n, err := context.TransactionBuf(NewRequest("card.version"), rspBuf)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("need %d", len(rspJSON))) {
+			t.Errorf("%d-byte buffer: expected a buffer too small error, got %v", len(rspBuf), err)
+		}
+		if n != 0 {
+			t.Errorf("%d-byte buffer: expected no response, got %d bytes", len(rspBuf), n)
+		}
+	}
+}
+
+func TestErrorJSON(t *testing.T) {
+	tests := []struct {
+		message string
+		err     error
+		errstr  string
+	}{
+		{"", nil, ""},
+		{"plain", nil, "plain"},
+		{"", fmt.Errorf("failed %s", ErrCardIo), "failed " + ErrCardIo},
+		{"context", fmt.Errorf("failed"), "context: failed"},
+		{"quote \" and backslash \\", nil, "quote \" and backslash \\"},
+		{"line\nbreak\ttab", fmt.Errorf("ctrl \x01"), "line\nbreak\ttab: ctrl \x01"},
+		{"unicode é中", nil, "unicode é中"},
+	}
+	for _, test := range tests {
+		rspJSON := ErrorJSON(test.message, test.err)
+		rsp, err := JSONToObject(rspJSON)
+		if err != nil {
+			t.Errorf("%q doesn't parse: %s", rspJSON, err)
+			continue
+		}
+		errstr, present := rsp["err"].(string)
+		if !present || errstr != test.errstr {
+			t.Errorf("%q: expected err %q, got %v", rspJSON, test.errstr, rsp["err"])
+		}
+		if len(rsp) != 1 {
+			t.Errorf("%q: expected only the err field", rspJSON)
+		}
+	}
+}
+
+func TestTransactionUnencodableRequest(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		sent := 0
+		context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+			sent++
+			return []byte("{}\n"), nil
+		})
+		context.DisableUA = debug
+		context.Debug = debug
+		context.DebugWriter = &strings.Builder{}
+		req := NewRequest("hub.set")
+		req["x"] = []interface{}{struct{}{}}
+		_, err := context.Transaction(req)
+		if err == nil {
+			t.Errorf("debug %v: expected an error encoding the request", debug)
+		}
+		if sent != 0 {
+			t.Errorf("debug %v: nothing should have been sent", debug)
+		}
+
+		// The request is encoded again to add the user agent, or else to trace it
+		_, err = context.TransactionJSONParsed([]byte("{\"req\":\"hub.set\"}"), req)
+		if err == nil {
+			t.Errorf("debug %v: expected an error encoding the parsed request", debug)
+		}
+		if sent != 0 {
+			t.Errorf("debug %v: nothing should have been sent for the parsed request", debug)
+		}
+	}
+}
+
+func TestTransactionJSONUserAgent(t *testing.T) {
+	var sentJSON []byte
+	context := newTestContext(func(reqJSON []byte) ([]byte, error) {
+		sentJSON = reqJSON
+		return []byte("{}\n"), nil
+	})
+	context.DisableUA = false
+	_, err := context.TransactionJSON([]byte("{\"req\":\"hub.set\",\"product\":\"com.example:test\"}"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	req, err := JSONToObject(sentJSON)
+	if err != nil {
+		t.Fatalf("the request sent, %q, doesn't decode: %s", sentJSON, err)
+	}
+	if _, present := req["body"].(map[string]interface{}); !present {
+		t.Errorf("the request sent, %s, has no user agent", sentJSON)
+	}
+}
+
+func TestRequestSegmentParams(t *testing.T) {
+	wasMaxLen, wasDelayMs := RequestSegmentMaxLen, RequestSegmentDelayMs
+	defer func() {
+		RequestSegmentMaxLen, RequestSegmentDelayMs = wasMaxLen, wasDelayMs
+	}()
+	tests := []struct {
+		contextMaxLen, contextDelayMs int
+		packageMaxLen, packageDelayMs int
+		maxLen, delayMs               int
+	}{
+		{RequestSegmentDefault, RequestSegmentDefault, RequestSegmentDefault, RequestSegmentDefault, 250, 250},
+		{1024, 50, RequestSegmentDefault, RequestSegmentDefault, 1024, 50},
+		{1024, 50, 100, 100, 1024, 50},
+		{RequestSegmentDefault, RequestSegmentDefault, 100, 100, 100, 100},
+		{RequestSegmentDefault, 50, 100, RequestSegmentDefault, 100, 50},
+		{RequestSegmentDefault, RequestSegmentDefault, 100, 0, 100, CardRequestSegmentMinDelayMs},
+		{1024, 0, RequestSegmentDefault, 100, 1024, CardRequestSegmentMinDelayMs},
+		{1024, 5, RequestSegmentDefault, RequestSegmentDefault, 1024, CardRequestSegmentMinDelayMs},
+		{0, 50, 100, RequestSegmentDefault, 250, 50},
+	}
+	context := newTestContext(nil)
+	if context.RequestSegmentMaxLen != RequestSegmentDefault || context.RequestSegmentDelayMs != RequestSegmentDefault {
+		t.Errorf("an opened context's segment pacing should be unset")
+	}
+	for _, test := range tests {
+		context.RequestSegmentMaxLen, context.RequestSegmentDelayMs = test.contextMaxLen, test.contextDelayMs
+		RequestSegmentMaxLen, RequestSegmentDelayMs = test.packageMaxLen, test.packageDelayMs
+		maxLen, delayMs := context.requestSegmentParams(250, 250)
+		if maxLen != test.maxLen || delayMs != test.delayMs {
+			t.Errorf("%+v: got %d, %d", test, maxLen, delayMs)
+		}
+	}
+}
+
+func TestRequestSegmentPackageVariables(t *testing.T) {
+	wasMaxLen, wasDelayMs := RequestSegmentMaxLen, RequestSegmentDelayMs
+	defer func() {
+		RequestSegmentMaxLen, RequestSegmentDelayMs = wasMaxLen, wasDelayMs
+	}()
+	RequestSegmentMaxLen, RequestSegmentDelayMs = 10, 30
+
+	// A freshly opened context over a UART that records the segments written to it
+	var segments []int
+	rspJSON := []byte("{}\n")
+	context, _ := OpenUART(func(data []byte) (n int, err error) {
+		n = copy(data, rspJSON)
+		rspJSON = rspJSON[n:]
+		return
+	}, func(data []byte) (n int, err error) {
+		segments = append(segments, len(data))
+		return len(data), nil
+	})
+	context.DisableUA = true
+	context.ResetFn = func(context *Context) error {
+		return nil
+	}
+	began := time.Now()
+	_, err := context.Transaction(NewRequest("card.version"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	elapsed := time.Since(began)
+	if len(segments) < 2 {
+		t.Fatalf("expected the request to be sent in segments, got %v", segments)
+	}
+	for _, length := range segments {
+		if length > RequestSegmentMaxLen {
+			t.Errorf("segment of %d bytes exceeds %d", length, RequestSegmentMaxLen)
+		}
+	}
+	minimum := time.Duration(len(segments)-1) * time.Duration(RequestSegmentDelayMs) * time.Millisecond
+	if elapsed < minimum || elapsed >= time.Duration(CardRequestSerialSegmentDelayMs)*time.Millisecond {
+		t.Errorf("%d segments took %s, but expected at least %s at %dms apart", len(segments), elapsed, minimum, RequestSegmentDelayMs)
+	}
+}
+
+func TestSegmentConfigRoundTrip(t *testing.T) {
+	context := newTestContext(nil)
+	config := context.ExportConfig()
+	context.RequestSegmentMaxLen, context.RequestSegmentDelayMs = 100, 100
+	err := context.ImportConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if context.RequestSegmentMaxLen != RequestSegmentDefault || context.RequestSegmentDelayMs != RequestSegmentDefault {
+		t.Errorf("unset segment pacing should survive export and import")
+	}
+	err = context.ImportConfig(map[string]interface{}{"segment_delay_ms": 0})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, delayMs := context.requestSegmentParams(CardRequestSerialSegmentMaxLen, CardRequestSerialSegmentDelayMs)
+	if delayMs != CardRequestSegmentMinDelayMs {
+		t.Errorf("a delay of 0 should be raised to %d, got %d", CardRequestSegmentMinDelayMs, delayMs)
+	}
+}
@@ -16,7 +16,7 @@ func (context *Context) UserAgent() (ua map[string]interface{}) {
 	ua = map[string]interface{}{}
 	ua["agent"] = "note-tinygo"
 	ua["compiler"] = fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH)
-	ua["req_interface"] = context.interfaceName
+	ua["req_interface"] = context.Identify()
 
 	return
 
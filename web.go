@@ -0,0 +1,170 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	gocontext "context"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// WebPostReader performs a web.post through the specified Notehub route, appending path to the
+// route's URL, with a body read from r.  Rather than encoding the entire body in memory, the
+// body is base64-encoded as it is read and streamed to the card as part of the request, so
+// the memory required is independent of the length of the body.  The card must nonetheless
+// be able to hold the entire request.  Because the body can't be read again, a request whose
+// response fails the check enabled by EnableCRC fails rather than being retried.
+func (context *Context) WebPostReader(route string, path string, r io.Reader, contentType string) (rsp map[string]interface{}, err error) {
+	return context.WebPostReaderWithContext(gocontext.Background(), route, path, r, contentType)
+}
+
+// WebPostReaderWithContext performs a web.post just as WebPostReader does, abandoning it if ctx
+// is canceled or its deadline passes, as TransactionWithContext does
+func (context *Context) WebPostReaderWithContext(ctx gocontext.Context, route string, path string, r io.Reader, contentType string) (rsp map[string]interface{}, err error) {
+
+	// Generate all of the request other than the payload, leaving it open for the payload
+	req := NewRequest("web.post")
+	req["route"] = route
+	if path != "" {
+		req["name"] = path
+	}
+	if contentType != "" {
+		req["content"] = contentType
+	}
+	reqJSON, err := ObjectToJSON(req)
+	if err != nil {
+		return
+	}
+
+	// Stream the request without letting any other transaction intervene
+	began, err := context.streamBegin(reqJSON, TransactionOptions{ctx: ctx})
+	var rspJSON []byte
+	if err == nil {
+		w := &requestStreamWriter{context: context}
+		if context.interfaceName == "i2c" {
+			w.maxLen, w.delayMs = context.requestSegmentParams(CardRequestI2CSegmentMaxLen, CardRequestI2CSegmentDelayMs)
+		} else {
+			w.maxLen, w.delayMs = context.requestSegmentParams(CardRequestSerialSegmentMaxLen, CardRequestSerialSegmentDelayMs)
+		}
+		if context.crcEnabled {
+			context.crcSeq++
+			w.crc = crc32.NewIEEE()
+		}
+		_, err = w.Write(append(reqJSON[:len(reqJSON)-1], []byte(",\"payload\":\"")...))
+		if err == nil {
+			encoder := base64.NewEncoder(base64.StdEncoding, w)
+			_, err = io.Copy(encoder, r)
+			if err == nil {
+				err = encoder.Close()
+			}
+		}
+		if err == nil {
+			_, err = w.Write([]byte("\""))
+		}
+		if err == nil {
+			rspJSON, err = w.finish()
+		} else if w.sent {
+			// The card has received a partial request, which must be discarded
+			context.resetRequired = true
+		}
+	}
+
+	// Decode the response
+	if err == nil {
+		rsp, err = JSONToObject(rspJSON)
+		if err != nil {
+			err = fmt.Errorf("web.post: error unmarshaling reply from module: %s %s", err, ErrCardIo)
+			context.resetRequired = true
+		}
+	}
+	context.streamEnd(began, rspJSON, rsp, err)
+	if err != nil {
+		return
+	}
+	if IsError(nil, rsp) {
+		err = fmt.Errorf("web.post: %s", ErrorString(nil, rsp))
+		return
+	}
+
+	// Done
+	return
+
+}
+
+// A writer that transmits a request to the card in paced segments as it is generated,
+// computing the request's CRC as it goes if crc is not nil
+type requestStreamWriter struct {
+	context *Context
+	maxLen  int
+	delayMs int
+	buf     []byte
+	sent    bool
+	crc     hash.Hash32
+}
+
+// Buffer data, transmitting each segment as it fills
+func (w *requestStreamWriter) Write(p []byte) (n int, err error) {
+	if w.crc != nil {
+		w.crc.Write(p)
+	}
+	for len(p) > 0 {
+		take := w.maxLen - len(w.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+		n += take
+		if len(w.buf) >= w.maxLen {
+			_, err = w.transmit(true)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Close the request, transmit what remains of it, and read the response
+func (w *requestStreamWriter) finish() (rspJSON []byte, err error) {
+	trailer := "}\n"
+	crc := w.crc
+	if crc != nil {
+		crc.Write([]byte("}"))
+		trailer = fmt.Sprintf(",%s%04X:%08X\"}\n", crcFieldName, w.context.crcSeq, crc.Sum32())
+		w.crc = nil
+	}
+	_, err = w.Write([]byte(trailer))
+	if err != nil {
+		return
+	}
+	rspJSON, err = w.transmit(false)
+	if err == nil && crc != nil {
+		rspJSON, err = crcCheck(rspJSON, w.context.crcSeq)
+	}
+	return
+}
+
+// Transmit the buffered segment
+func (w *requestStreamWriter) transmit(noResponse bool) (rspJSON []byte, err error) {
+	if w.sent {
+		time.Sleep(time.Duration(w.delayMs) * time.Millisecond)
+		err = w.context.transCanceled()
+		if err != nil {
+			return
+		}
+	}
+	rspJSON, err = w.context.TransactionFn(w.context, noResponse, w.buf)
+	w.sent = true
+	w.buf = w.buf[:0]
+	if err != nil {
+		w.context.resetRequired = true
+	}
+	return
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package tinynote
+
+import (
+	"bytes"
+	gocontext "context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Open a context whose card assembles each streamed request from its segments, verifying its
+// CRC if it has one, and returns the decoded request to respond, protecting the response with
+// a CRC if the request had one
+func newTestStreamContext(respond func(req map[string]interface{}) (rspJSON []byte)) (context *Context, segments *int) {
+	var reqJSON []byte
+	segments = new(int)
+	context = newTestContext(nil)
+	context.RequestSegmentMaxLen, context.RequestSegmentDelayMs = 16, 0
+	context.TransactionFn = func(context *Context, noResponse bool, segment []byte) ([]byte, error) {
+		*segments++
+		reqJSON = append(reqJSON, segment...)
+		if noResponse {
+			return nil, nil
+		}
+		checkedJSON, err := crcCheck(reqJSON, context.crcSeq)
+		hasCRC := len(checkedJSON) != len(reqJSON)
+		reqJSON = nil
+		if err != nil {
+			return nil, err
+		}
+		req, err := JSONToObject(checkedJSON)
+		if err != nil {
+			return nil, err
+		}
+		rspJSON := bytes.TrimRight(respond(req), "\n")
+		if hasCRC {
+			rspJSON = crcAdd(rspJSON, context.crcSeq)
+		}
+		return append(rspJSON, '\n'), nil
+	}
+	return
+}
+
+// Respond to a web.post with the length of its decoded payload
+func testWebPostRespond(req map[string]interface{}) (rspJSON []byte) {
+	payload, err := DecodePayload(stringField(req, "payload"), nil)
+	if err != nil || stringField(req, "req") != "web.post" {
+		return []byte("{\"err\":\"bad request\"}")
+	}
+	return []byte(fmt.Sprintf("{\"result\":200,\"body\":{\"length\":%d}}", len(payload)))
+}
+
+func TestWebPostReader(t *testing.T) {
+	for _, crc := range []bool{false, true} {
+		context, segments := newTestStreamContext(testWebPostRespond)
+		context.EnableCRC(crc)
+		body := strings.Repeat("streamed body ", 20)
+		rsp, err := context.WebPostReader("route", "path", strings.NewReader(body), "text/plain")
+		if err != nil {
+			t.Fatalf("crc %v: unexpected error: %s", crc, err)
+		}
+		length := intField(rsp["body"].(map[string]interface{}), "length")
+		if length != len(body) {
+			t.Errorf("crc %v: the card received %d bytes rather than %d", crc, length, len(body))
+		}
+		if *segments < 2 {
+			t.Errorf("crc %v: expected the request to be sent in segments", crc)
+		}
+		if context.Stats().Transactions != 1 || context.Stats().Errors != 0 {
+			t.Errorf("crc %v: expected one successful transaction, got %+v", crc, context.Stats())
+		}
+	}
+}
+
+func TestWebPostReaderCardError(t *testing.T) {
+	context, _ := newTestStreamContext(func(req map[string]interface{}) []byte {
+		return []byte("{\"err\":\"no route {not-supported}\"}")
+	})
+	_, err := context.WebPostReader("route", "", strings.NewReader("body"), "")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if context.resetRequired {
+		t.Errorf("an error reported by the card should not require a reset")
+	}
+	if context.Stats().Errors != 1 {
+		t.Errorf("expected the error to be counted, got %+v", context.Stats())
+	}
+}
+
+func TestWebPostReaderResetFailure(t *testing.T) {
+	context, segments := newTestStreamContext(testWebPostRespond)
+	context.ResetFn = func(context *Context) error {
+		return fmt.Errorf("reset failed %s", ErrCardIo)
+	}
+	context.resetRequired = true
+	_, err := context.WebPostReader("route", "", strings.NewReader("body"), "")
+	if err == nil || !strings.Contains(err.Error(), "reset failed") {
+		t.Errorf("expected the reset error, got %v", err)
+	}
+	if *segments != 0 {
+		t.Errorf("nothing should be sent when the reset fails")
+	}
+}
+
+func TestWebPostReaderFault(t *testing.T) {
+	context, segments := newTestStreamContext(testWebPostRespond)
+	context.FaultFn = func(reqJSON []byte) error {
+		return fmt.Errorf("injected %s", ErrCardIo)
+	}
+	_, err := context.WebPostReader("route", "", strings.NewReader("body"), "")
+	if !errorHasCode(err, ErrCardIo) {
+		t.Errorf("expected the injected error, got %v", err)
+	}
+	if *segments != 0 {
+		t.Errorf("nothing should be sent when a fault is injected")
+	}
+}
+
+func TestWebPostReaderCanceled(t *testing.T) {
+	context, segments := newTestStreamContext(testWebPostRespond)
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	_, err := context.WebPostReaderWithContext(ctx, "route", "", strings.NewReader("body"), "")
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Errorf("expected a cancellation error, got %v", err)
+	}
+	if *segments != 0 {
+		t.Errorf("nothing should be sent once canceled")
+	}
+	if context.Stats().Errors != 1 {
+		t.Errorf("expected the error to be counted, got %+v", context.Stats())
+	}
+}